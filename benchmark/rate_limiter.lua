@@ -0,0 +1,11 @@
+-- Fixed window rate limiter. KEYS[1] counts the requests of the current
+-- window, ARGV[1] is the number of requests allowed per window and ARGV[2]
+-- the window in seconds. Returns 1 when the request is allowed.
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+    redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+if count > tonumber(ARGV[1]) then
+    return 0
+end
+return 1
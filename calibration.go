@@ -0,0 +1,57 @@
+package main
+
+import "fmt"
+
+// calibrationTarget is the no-op backend behind the HTTP shim. It listens on
+// the base port so it never collides with the shims in front of --hosts.
+var calibrationTarget = target{
+	name:     "http shim",
+	host:     "localhost",
+	port:     httpBasePort,
+	httpPort: httpBasePort,
+}
+
+// calibrationFloorLoad is the fraction of the shim's throughput ceiling its
+// latency floor is measured at, low enough that queueing doesn't dominate.
+const calibrationFloorLoad = 0.1
+
+// runCalibration measures the HTTP shim on its own, the throughput ceiling
+// with the closed loop and the latency floor with the open loop at a light
+// load.
+func runCalibration() (*result, error) {
+	r := &result{name: calibrationTarget.name}
+
+	if err := runThroughputBenchmark(calibrationTarget, stageOptions(), r); err != nil {
+		return nil, err
+	}
+	if err := runLatencyBenchmark(calibrationTarget, stageOptions(), int(r.throughput*calibrationFloorLoad), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// flagHarnessBound marks every result whose throughput is within
+// --harness-margin of the shim's ceiling, those numbers say more about the
+// shim than about the target.
+func flagHarnessBound(results []*result, calibration *result) {
+	threshold := calibration.throughput * (1 - *harnessMargin)
+	for _, r := range results {
+		r.harnessBound = r.throughput >= threshold
+	}
+}
+
+func printCalibration(results []*result, calibration *result) {
+	fmt.Printf("%s ceiling: %.2f requests/sec, latency floor p50: %.3fms p99: %.3fms\n",
+		calibration.name,
+		calibration.throughput,
+		milliseconds(calibration.latency.valueAtPercentile(50)),
+		milliseconds(calibration.latency.valueAtPercentile(99)))
+
+	for _, r := range results {
+		fmt.Printf("\t%s: %.2f requests/sec, %.1f%% of ceiling", r.name, r.throughput, 100*r.throughput/calibration.throughput)
+		if r.harnessBound {
+			fmt.Print(" (harness-bound)")
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// histogram is a high dynamic range histogram in the style of HdrHistogram.
+// Values are bucketed so that every recorded value is accurate to the
+// configured number of significant digits across the whole trackable range,
+// while the memory footprint stays fixed regardless of how many values are
+// recorded. Recording is safe for concurrent use; reading is not and should
+// only happen once recording has finished.
+type histogram struct {
+	lowestTrackableValue        int64
+	highestTrackableValue       int64
+	significantDigits           int
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+	subBucketCount              int
+	subBucketHalfCount          int
+	subBucketMask               int64
+	bucketCount                 int
+
+	counts     []int64
+	totalCount int64
+	minValue   int64
+	maxValue   int64
+}
+
+// newHistogram creates a histogram able to track values between lowest and
+// highest with the given number of significant digits (1 to 5).
+func newHistogram(lowest int64, highest int64, significantDigits int) (*histogram, error) {
+	if significantDigits < 1 || significantDigits > 5 {
+		return nil, fmt.Errorf("significant digits must be between 1 and 5, got %d", significantDigits)
+	}
+	if lowest < 1 {
+		return nil, fmt.Errorf("lowest trackable value must be at least 1, got %d", lowest)
+	}
+	if highest < 2*lowest {
+		return nil, fmt.Errorf("highest trackable value %d must be at least twice the lowest %d", highest, lowest)
+	}
+
+	h := &histogram{
+		lowestTrackableValue:  lowest,
+		highestTrackableValue: highest,
+		significantDigits:     significantDigits,
+		minValue:              math.MaxInt64,
+	}
+
+	largestValueWithSingleUnitResolution := 2 * math.Pow10(significantDigits)
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(largestValueWithSingleUnitResolution)))
+	if subBucketCountMagnitude < 1 {
+		subBucketCountMagnitude = 1
+	}
+	h.subBucketHalfCountMagnitude = subBucketCountMagnitude - 1
+	h.unitMagnitude = uint(math.Floor(math.Log2(float64(lowest))))
+	h.subBucketCount = 1 << (h.subBucketHalfCountMagnitude + 1)
+	h.subBucketHalfCount = h.subBucketCount / 2
+	h.subBucketMask = int64(h.subBucketCount-1) << h.unitMagnitude
+
+	// Each bucket doubles the range covered by the one before it, so find
+	// how many are needed before the highest value fits.
+	smallestUntrackableValue := int64(h.subBucketCount) << h.unitMagnitude
+	h.bucketCount = 1
+	for smallestUntrackableValue <= highest {
+		if smallestUntrackableValue > math.MaxInt64/2 {
+			h.bucketCount++
+			break
+		}
+		smallestUntrackableValue <<= 1
+		h.bucketCount++
+	}
+
+	h.counts = make([]int64, (h.bucketCount+1)*h.subBucketHalfCount)
+	return h, nil
+}
+
+// newLatencyHistogram creates a histogram of microsecond latencies from 1µs
+// up to one hour at the configured precision.
+func newLatencyHistogram() *histogram {
+	h, err := newHistogram(1, int64(time.Hour/time.Microsecond), int(*significantDigits))
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// recordLatency records a latency at microsecond resolution.
+func (h *histogram) recordLatency(latency time.Duration) {
+	h.recordValues(int64(latency/time.Microsecond), 1)
+}
+
+// recordValues records count occurrences of value. Values beyond the
+// trackable range are clamped to it so no sample is ever dropped.
+func (h *histogram) recordValues(value int64, count int64) {
+	if value < 0 {
+		value = 0
+	}
+	if value > h.highestTrackableValue {
+		value = h.highestTrackableValue
+	}
+
+	atomic.AddInt64(&h.counts[h.countsIndexFor(value)], count)
+	atomic.AddInt64(&h.totalCount, count)
+
+	for {
+		min := atomic.LoadInt64(&h.minValue)
+		if value >= min || atomic.CompareAndSwapInt64(&h.minValue, min, value) {
+			break
+		}
+	}
+	for {
+		max := atomic.LoadInt64(&h.maxValue)
+		if value <= max || atomic.CompareAndSwapInt64(&h.maxValue, max, value) {
+			break
+		}
+	}
+}
+
+// merge adds every value recorded in other to h. The histograms don't need to
+// share the same range or precision.
+func (h *histogram) merge(other *histogram) {
+	if other.totalCount == 0 {
+		return
+	}
+
+	minValue, maxValue := h.minValue, h.maxValue
+	for i, count := range other.counts {
+		if count > 0 {
+			h.recordValues(other.valueFromCountsIndex(i), count)
+		}
+	}
+
+	// Merged values are only as precise as the buckets they came from, so
+	// carry the exact extremes across instead.
+	if other.minValue < minValue {
+		minValue = other.minValue
+	}
+	if other.maxValue > maxValue {
+		maxValue = other.maxValue
+	}
+	if maxValue > h.highestTrackableValue {
+		maxValue = h.highestTrackableValue
+	}
+	h.minValue, h.maxValue = minValue, maxValue
+}
+
+func (h *histogram) count() int64 {
+	return h.totalCount
+}
+
+func (h *histogram) min() int64 {
+	if h.totalCount == 0 {
+		return 0
+	}
+	return h.minValue
+}
+
+func (h *histogram) max() int64 {
+	return h.maxValue
+}
+
+func (h *histogram) mean() float64 {
+	if h.totalCount == 0 {
+		return 0
+	}
+	var total float64
+	for i, count := range h.counts {
+		if count > 0 {
+			total += float64(count) * float64(h.medianEquivalentValue(h.valueFromCountsIndex(i)))
+		}
+	}
+	return total / float64(h.totalCount)
+}
+
+func (h *histogram) stdDev() float64 {
+	if h.totalCount == 0 {
+		return 0
+	}
+	mean := h.mean()
+	var geometricDevTotal float64
+	for i, count := range h.counts {
+		if count > 0 {
+			dev := float64(h.medianEquivalentValue(h.valueFromCountsIndex(i))) - mean
+			geometricDevTotal += dev * dev * float64(count)
+		}
+	}
+	return math.Sqrt(geometricDevTotal / float64(h.totalCount))
+}
+
+// valueAtPercentile returns the largest value that the given percentage
+// (0-100) of recorded values are less than or equal to.
+func (h *histogram) valueAtPercentile(percentile float64) int64 {
+	if h.totalCount == 0 {
+		return 0
+	}
+	if percentile > 100 {
+		percentile = 100
+	}
+	if percentile >= 100 {
+		return h.maxValue
+	}
+
+	countAtPercentile := int64(percentile/100*float64(h.totalCount) + 0.5)
+	if countAtPercentile < 1 {
+		countAtPercentile = 1
+	}
+
+	var total int64
+	for i, count := range h.counts {
+		total += count
+		if total >= countAtPercentile {
+			value := h.highestEquivalentValue(h.valueFromCountsIndex(i))
+			if value > h.maxValue {
+				return h.maxValue
+			}
+			return value
+		}
+	}
+	return h.maxValue
+}
+
+func (h *histogram) bucketIndex(value int64) int {
+	pow2Ceiling := bits.Len64(uint64(value | h.subBucketMask))
+	return pow2Ceiling - int(h.unitMagnitude) - int(h.subBucketHalfCountMagnitude+1)
+}
+
+func (h *histogram) subBucketIndex(value int64, bucketIndex int) int {
+	return int(value >> (uint(bucketIndex) + h.unitMagnitude))
+}
+
+func (h *histogram) countsIndex(bucketIndex int, subBucketIndex int) int {
+	bucketBaseIndex := (bucketIndex + 1) << h.subBucketHalfCountMagnitude
+	return bucketBaseIndex + subBucketIndex - h.subBucketHalfCount
+}
+
+func (h *histogram) countsIndexFor(value int64) int {
+	bucketIndex := h.bucketIndex(value)
+	return h.countsIndex(bucketIndex, h.subBucketIndex(value, bucketIndex))
+}
+
+func (h *histogram) valueFromCountsIndex(index int) int64 {
+	bucketIndex := (index >> h.subBucketHalfCountMagnitude) - 1
+	subBucketIndex := (index & (h.subBucketHalfCount - 1)) + h.subBucketHalfCount
+	if bucketIndex < 0 {
+		subBucketIndex -= h.subBucketHalfCount
+		bucketIndex = 0
+	}
+	return int64(subBucketIndex) << (uint(bucketIndex) + h.unitMagnitude)
+}
+
+func (h *histogram) sizeOfEquivalentValueRange(value int64) int64 {
+	bucketIndex := h.bucketIndex(value)
+	subBucketIndex := h.subBucketIndex(value, bucketIndex)
+	if subBucketIndex >= h.subBucketCount {
+		bucketIndex++
+	}
+	return 1 << (h.unitMagnitude + uint(bucketIndex))
+}
+
+func (h *histogram) lowestEquivalentValue(value int64) int64 {
+	bucketIndex := h.bucketIndex(value)
+	subBucketIndex := h.subBucketIndex(value, bucketIndex)
+	return int64(subBucketIndex) << (uint(bucketIndex) + h.unitMagnitude)
+}
+
+func (h *histogram) highestEquivalentValue(value int64) int64 {
+	return h.lowestEquivalentValue(value) + h.sizeOfEquivalentValueRange(value) - 1
+}
+
+func (h *histogram) medianEquivalentValue(value int64) int64 {
+	return h.lowestEquivalentValue(value) + h.sizeOfEquivalentValueRange(value)>>1
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/valyala/fasthttp"
+)
+
+// httpConn issues commands through the HTTP shim in http_server.go, one PUT
+// per command with the keyspace, command and key carried in headers. The
+// value travels in the body since large values wouldn't fit the shim's
+// header buffer.
+type httpConn struct {
+	address  string
+	keyspace string
+	netConn  net.Conn
+	br       *bufio.Reader
+	bw       *bufio.Writer
+	req      fasthttp.Request
+	resp     fasthttp.Response
+}
+
+func dialHTTP(address string, ks keyspace) (conn, error) {
+	netConn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &httpConn{
+		address:  address,
+		keyspace: ks.String(),
+		netConn:  netConn,
+		br:       bufio.NewReader(netConn),
+		bw:       bufio.NewWriter(netConn),
+	}, nil
+}
+
+func (c *httpConn) Send(commandName string, args ...interface{}) error {
+	c.req.Reset()
+	c.req.Header.SetMethod("PUT")
+	c.req.SetRequestURI("/")
+	c.req.Header.SetHost(c.address)
+	c.req.Header.Set("keyspace", c.keyspace)
+	c.req.Header.Set("command", commandName)
+	if len(args) > 0 {
+		c.req.Header.Set("key", fmt.Sprint(args[0]))
+	}
+	if len(args) > 1 {
+		if value, ok := args[1].([]byte); ok {
+			c.req.SetBody(value)
+		} else {
+			c.req.SetBodyString(fmt.Sprint(args[1]))
+		}
+	}
+	return c.req.Write(c.bw)
+}
+
+func (c *httpConn) Flush() error {
+	return c.bw.Flush()
+}
+
+func (c *httpConn) Receive() (interface{}, error) {
+	c.resp.Reset()
+	if err := c.resp.Read(c.br); err != nil {
+		return nil, err
+	}
+	if c.resp.StatusCode() != fasthttp.StatusOK {
+		// The shim answers 500 with the error when Redis rejected the
+		// command or couldn't be reached, which is a failed request rather
+		// than a broken connection to the shim.
+		if body := c.resp.Body(); len(body) > 0 {
+			return nil, redis.Error(body)
+		}
+		return nil, redis.Error(fmt.Sprintf("http status %d", c.resp.StatusCode()))
+	}
+	// The body is the bulk reply, if any. It is copied since the response
+	// is reused by the next Receive.
+	if body := c.resp.Body(); len(body) > 0 {
+		return append([]byte(nil), body...), nil
+	}
+	return nil, nil
+}
+
+func (c *httpConn) Close() error {
+	return c.netConn.Close()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -11,15 +12,17 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
-var pools map[int64]*redis.Pool
+// pools holds the Redis pools of every shim by its port, one pool per
+// database its requests may select with the keyspace header.
+var pools map[int64]map[int]*redis.Pool
 
-func newPool(server string, connections int) *redis.Pool {
+func newPool(server string, database int, connections int) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     connections,
 		MaxActive:   connections,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
+			c, err := redis.Dial("tcp", server, redis.DialDatabase(database))
 			if err != nil {
 				return nil, err
 			}
@@ -39,37 +42,101 @@ func newPool(server string, connections int) *redis.Pool {
 	}
 }
 
-func startHTTPServer(redisServer string, connections int, httpPort int) {
-	pool := newPool(redisServer, connections)
-	pools[int64(httpPort)] = pool
+func startHTTPServer(redisServer string, databases []int, connections int, httpPort int) {
+	databasePools := make(map[int]*redis.Pool)
+	for _, database := range databases {
+		databasePools[database] = newPool(redisServer, database, connections)
+	}
+	pools[int64(httpPort)] = databasePools
+	serveHTTP(httpPort)
+}
+
+// startNoopHTTPServer starts a shim with no Redis behind it. Requests take the
+// same requestHandler path but are answered without a Redis round trip, which
+// measures what the shim itself costs.
+func startNoopHTTPServer(httpPort int) {
+	pools[int64(httpPort)] = nil
+	serveHTTP(httpPort)
+}
 
-	if err := fasthttp.ListenAndServe(":"+strconv.Itoa(httpPort), requestHandler); err != nil {
-		log.Fatalf("Error in ListenAndServe: %s", err)
+// serveHTTP binds the listener before returning so the load generator can
+// connect as soon as the benchmark starts, and serves in the background.
+func serveHTTP(httpPort int) {
+	ln, err := net.Listen("tcp4", ":"+strconv.Itoa(httpPort))
+	if err != nil {
+		log.Fatalf("Error in Listen: %s", err)
 	}
+	go func() {
+		if err := fasthttp.Serve(ln, requestHandler); err != nil {
+			log.Fatalf("Error in Serve: %s", err)
+		}
+	}()
 }
 
 func requestHandler(ctx *fasthttp.RequestCtx) {
 	addressParts := strings.Split(ctx.LocalAddr().String(), ":")
 	port, _ := strconv.ParseInt(addressParts[1], 10, 32)
-	pool := pools[port]
-	conn := pool.Get()
+	databasePools := pools[port]
 
+	// The keyspace header picks the database and the prefix of the key, no
+	// header is database 0 without a prefix.
+	var ks keyspace
+	if header := ctx.Request.Header.Peek("keyspace"); len(header) > 0 {
+		var err error
+		if ks, err = parseKeyspace(string(header)); err != nil {
+			ctx.Response.SetStatusCode(400)
+			fmt.Println(err)
+			return
+		}
+	}
+
+	command := string(ctx.Request.Header.Peek("command"))
+	if command == "" {
+		command = "SET"
+	}
+	// The pools are per database, so no request may switch or wipe one.
+	if keyspaceEscapes[strings.ToUpper(command)] {
+		ctx.Response.SetStatusCode(400)
+		fmt.Printf("can't send %s through the shim\n", command)
+		return
+	}
 	key := ctx.Request.Header.Peek("key")
-	value := ctx.Request.Header.Peek("value")
+	if ks.prefix != "" {
+		key = append([]byte(ks.prefix), key...)
+	}
+	args := []interface{}{key}
+	if value := ctx.Request.Header.Peek("value"); len(value) > 0 {
+		args = append(args, value)
+	} else if value := ctx.PostBody(); len(value) > 0 {
+		args = append(args, value)
+	}
 
-	// _, err := conn.Send("SET", key, value)
-	err := conn.Send("SET", key, value)
-	if err != nil {
-		ctx.Response.SetStatusCode(500)
-		fmt.Println(err)
-	} else {
+	if databasePools == nil {
 		ctx.Response.SetStatusCode(200)
+		return
+	}
+	pool, ok := databasePools[ks.database]
+	if !ok {
+		ctx.Response.SetStatusCode(400)
+		fmt.Printf("no pool for database %d\n", ks.database)
+		return
 	}
-	if ctx.ConnRequestNum()%uint64(*pipelined) == 0 {
-		conn.Flush()
-		for i := 0; i < int(*pipelined); i++ {
-			conn.Receive()
+	conn := pool.Get()
+	defer conn.Close()
+
+	// Wait for the reply so that commands Redis rejects are answered with
+	// a 500 carrying its error, and a bulk reply comes back in the body.
+	reply, err := conn.Do(command, args...)
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			fmt.Println(err)
 		}
+		ctx.Response.SetStatusCode(500)
+		ctx.Response.SetBodyString(err.Error())
+		return
+	}
+	ctx.Response.SetStatusCode(200)
+	if value, ok := reply.([]byte); ok {
+		ctx.Response.SetBody(value)
 	}
-	conn.Close()
 }
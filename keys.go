@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// keyDistribution decides which keys of a keyspace of count keys a workload
+// touches and how often.
+type keyDistribution interface {
+	// picker returns a function drawing key indexes in [0, count) for a
+	// single generator using its rng. position is shared by the generators
+	// of a stage, for distributions that walk the keyspace together.
+	picker(rng *rand.Rand, position *int64) func() int64
+	// size is the number of keys in the keyspace.
+	size() int64
+}
+
+// keyName names the key at index in the keyspace.
+func keyName(index int64) string {
+	return fmt.Sprintf("%010d", index)
+}
+
+func newKeyDistribution(kind string, count int64, skew float64, hotKeys float64, hotOps float64) (keyDistribution, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("keyspace needs at least one key, got %d", count)
+	}
+
+	switch kind {
+	case "uniform":
+		return uniformKeys{count: count}, nil
+	case "zipf":
+		return newZipfKeys(count, skew)
+	case "hotspot":
+		if hotKeys <= 0 || hotKeys >= 1 {
+			return nil, fmt.Errorf("hotspot key fraction must be between 0 and 1, got %g", hotKeys)
+		}
+		if hotOps < 0 || hotOps > 1 {
+			return nil, fmt.Errorf("hotspot operation fraction must be between 0 and 1, got %g", hotOps)
+		}
+		hotCount := int64(float64(count) * hotKeys)
+		if hotCount < 1 {
+			hotCount = 1
+		}
+		return hotspotKeys{count: count, hotCount: hotCount, hotOps: hotOps}, nil
+	case "sequential":
+		return sequentialKeys{count: count}, nil
+	}
+	return nil, fmt.Errorf("unknown key distribution %q", kind)
+}
+
+// uniformKeys picks every key with the same probability.
+type uniformKeys struct {
+	count int64
+}
+
+func (u uniformKeys) size() int64 { return u.count }
+
+func (u uniformKeys) picker(rng *rand.Rand, position *int64) func() int64 {
+	return func() int64 {
+		return rng.Int63n(u.count)
+	}
+}
+
+// hotspotKeys sends hotOps of the operations to the first hotCount keys and
+// spreads the rest uniformly over the remaining ones.
+type hotspotKeys struct {
+	count    int64
+	hotCount int64
+	hotOps   float64
+}
+
+func (h hotspotKeys) size() int64 { return h.count }
+
+func (h hotspotKeys) picker(rng *rand.Rand, position *int64) func() int64 {
+	return func() int64 {
+		if h.hotCount >= h.count || rng.Float64() < h.hotOps {
+			return rng.Int63n(h.hotCount)
+		}
+		return h.hotCount + rng.Int63n(h.count-h.hotCount)
+	}
+}
+
+// sequentialKeys walks the keyspace in order, wrapping around at the end.
+// The generators of a stage share the position so that together they touch
+// each key once per pass, and every stage starts over from the first key.
+type sequentialKeys struct {
+	count int64
+}
+
+func (s sequentialKeys) size() int64 { return s.count }
+
+func (s sequentialKeys) picker(rng *rand.Rand, position *int64) func() int64 {
+	return func() int64 {
+		return (atomic.AddInt64(position, 1) - 1) % s.count
+	}
+}
+
+// zipfKeys picks key i with probability proportional to 1/(i+1)^skew, so a
+// handful of low keys take most of the traffic. Skews below 1 use the method
+// from Gray et al., "Quickly Generating Billion-Record Synthetic Databases",
+// as YCSB does, skews above 1 the standard library's rejection sampler.
+type zipfKeys struct {
+	count int64
+	skew  float64
+	zetan float64
+	alpha float64
+	eta   float64
+}
+
+func newZipfKeys(count int64, skew float64) (*zipfKeys, error) {
+	if skew <= 0 || skew == 1 {
+		return nil, fmt.Errorf("zipf skew must be positive and not 1, got %g", skew)
+	}
+	z := &zipfKeys{count: count, skew: skew}
+	if skew > 1 {
+		return z, nil
+	}
+
+	for i := int64(1); i <= count; i++ {
+		z.zetan += 1 / math.Pow(float64(i), skew)
+	}
+	zeta2 := 1 + 1/math.Pow(2, skew)
+	z.alpha = 1 / (1 - skew)
+	z.eta = (1 - math.Pow(2/float64(count), 1-skew)) / (1 - zeta2/z.zetan)
+	return z, nil
+}
+
+func (z *zipfKeys) size() int64 { return z.count }
+
+func (z *zipfKeys) picker(rng *rand.Rand, position *int64) func() int64 {
+	if z.skew > 1 {
+		zipf := rand.NewZipf(rng, z.skew, 1, uint64(z.count-1))
+		return func() int64 {
+			return int64(zipf.Uint64())
+		}
+	}
+
+	return func() int64 {
+		u := rng.Float64()
+		uz := u * z.zetan
+		if uz < 1 {
+			return 0
+		}
+		if uz < 1+math.Pow(0.5, z.skew) {
+			return 1 % z.count
+		}
+		key := int64(float64(z.count) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+		if key >= z.count {
+			key = z.count - 1
+		}
+		return key
+	}
+}
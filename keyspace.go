@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keyspace is a Redis logical database along with a prefix put in front of
+// every key sent to it, which keeps the benchmark's keys apart from other
+// data on a shared instance and lets tenants be laid out side by side.
+type keyspace struct {
+	database int
+	prefix   string
+}
+
+// parseKeyspaces parses comma separated keyspaces such as 1,2:tenant-a: where
+// each is a database optionally followed by a colon and a key prefix. An
+// empty spec is database 0 without a prefix.
+func parseKeyspaces(spec string) ([]keyspace, error) {
+	if spec == "" {
+		return []keyspace{{}}, nil
+	}
+	var keyspaces []keyspace
+	for _, field := range strings.Split(spec, ",") {
+		ks, err := parseKeyspace(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		keyspaces = append(keyspaces, ks)
+	}
+	return keyspaces, nil
+}
+
+func parseKeyspace(spec string) (keyspace, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	database, err := strconv.Atoi(parts[0])
+	if err != nil || database < 0 {
+		return keyspace{}, fmt.Errorf("invalid keyspace %q, expected DATABASE or DATABASE:PREFIX", spec)
+	}
+	ks := keyspace{database: database}
+	if len(parts) == 2 {
+		ks.prefix = parts[1]
+	}
+	return ks, nil
+}
+
+func (ks keyspace) String() string {
+	if ks.prefix == "" {
+		return strconv.Itoa(ks.database)
+	}
+	return fmt.Sprintf("%d:%s", ks.database, ks.prefix)
+}
+
+// keyspaceDatabases lists the databases the keyspaces of every workload
+// phase use.
+func keyspaceDatabases() []int {
+	var databases []int
+	seen := make(map[int]bool)
+	for _, w := range workloadPhases {
+		for _, ks := range w.keyspaces {
+			if !seen[ks.database] {
+				seen[ks.database] = true
+				databases = append(databases, ks.database)
+			}
+		}
+	}
+	return databases
+}
+
+// keyspaceConn keeps the commands sent over it within its keyspace. It puts
+// the keyspace's prefix in front of the keys of every command, and commands
+// whose keys are unknown or that reach other databases fail rather than
+// touch data outside the keyspace.
+type keyspaceConn struct {
+	conn
+	prefix string
+}
+
+// keyspaceEscapes holds the commands that switch or wipe databases
+// whatever the keys a keyspace has.
+var keyspaceEscapes = map[string]bool{
+	"SELECT":   true,
+	"SWAPDB":   true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+}
+
+func (c *keyspaceConn) Send(commandName string, args ...interface{}) error {
+	command := strings.ToUpper(commandName)
+	if keyspaceEscapes[command] {
+		return fmt.Errorf("can't send %s, it reaches outside the keyspace", commandName)
+	}
+	if c.prefix == "" {
+		return c.conn.Send(commandName, args...)
+	}
+	indexes, ok := keyIndexes(command, len(args), func(i int) string {
+		return argString(args[i])
+	})
+	if !ok {
+		return fmt.Errorf("can't prefix the keys of %s, they are unknown", commandName)
+	}
+	if len(indexes) > 0 {
+		// Replay sends the same arguments again on the next trial, so
+		// prefix a copy of them.
+		prefixed := append([]interface{}(nil), args...)
+		for _, i := range indexes {
+			prefixed[i] = c.prefix + argString(args[i])
+		}
+		args = prefixed
+	}
+	return c.conn.Send(commandName, args...)
+}
+
+func argString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// keyFinder finds the indexes of the keys among the n arguments of a
+// command, arg returning the argument at an index. It returns false when
+// the arguments leave the keys unknown.
+type keyFinder func(n int, arg func(int) string) ([]int, bool)
+
+func noKeys(n int, arg func(int) string) ([]int, bool) { return nil, true }
+
+// keysBetween finds the keys from first to last, step arguments apart. A
+// negative last counts from the end, -1 being the last argument.
+func keysBetween(first, last, step int) keyFinder {
+	return func(n int, arg func(int) string) ([]int, bool) {
+		end := last
+		if end < 0 {
+			end += n
+		}
+		var indexes []int
+		for i := first; i <= end && i < n; i += step {
+			indexes = append(indexes, i)
+		}
+		return indexes, true
+	}
+}
+
+// keysCounted finds the keys following the number of keys at index count,
+// along with the keys from index from up to it.
+func keysCounted(count, from int) keyFinder {
+	return func(n int, arg func(int) string) ([]int, bool) {
+		if count >= n {
+			return nil, false
+		}
+		keys, err := strconv.Atoi(arg(count))
+		if err != nil {
+			return nil, false
+		}
+		var indexes []int
+		for i := from; i < count; i++ {
+			indexes = append(indexes, i)
+		}
+		for i := count + 1; i <= count+keys && i < n; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes, true
+	}
+}
+
+// keysAfterStreams finds the keys of XREAD and XREADGROUP, which follow
+// STREAMS along with as many ids.
+func keysAfterStreams(n int, arg func(int) string) ([]int, bool) {
+	for i := 0; i < n; i++ {
+		if strings.EqualFold(arg(i), "STREAMS") {
+			return keysBetween(i+1, i+(n-i-1)/2, 1)(n, arg)
+		}
+	}
+	return nil, false
+}
+
+// keysStored finds the key of a command at index 0 along with the
+// destinations following STORE and STOREDIST among its options, which
+// start at index from.
+func keysStored(from int) keyFinder {
+	return func(n int, arg func(int) string) ([]int, bool) {
+		indexes := []int{0}
+		for i := from; i < n; i++ {
+			option := strings.ToUpper(arg(i))
+			if (option == "STORE" || option == "STOREDIST") && i+1 < n {
+				i++
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes, true
+	}
+}
+
+// sortKeys finds the key of SORT and SORT_RO along with the destination of
+// STORE. The keys BY and GET patterns look up are unknown, other than the
+// ones that look up nothing.
+func sortKeys(n int, arg func(int) string) ([]int, bool) {
+	indexes := []int{0}
+	for i := 1; i < n; i++ {
+		switch strings.ToUpper(arg(i)) {
+		case "BY":
+			if i+1 < n && !strings.EqualFold(arg(i+1), "NOSORT") {
+				return nil, false
+			}
+			i++
+		case "GET":
+			if i+1 < n && arg(i+1) != "#" {
+				return nil, false
+			}
+			i++
+		case "LIMIT":
+			i += 2
+		case "STORE":
+			if i+1 < n {
+				i++
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	return indexes, true
+}
+
+// commandKeys knows where the keys of the commands of every data type are.
+// Commands that take a subcommand first have their key second.
+var commandKeys = func() map[string]keyFinder {
+	commands := make(map[string]keyFinder)
+	add := func(finder keyFinder, names ...string) {
+		for _, name := range names {
+			commands[name] = finder
+		}
+	}
+
+	add(noKeys, "PING", "ECHO", "INFO", "SELECT", "MULTI", "EXEC", "DISCARD",
+		"UNWATCH", "SCRIPT", "FLUSHDB", "FLUSHALL", "DBSIZE", "CLIENT", "CONFIG",
+		"PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE",
+		"QUIT", "HELLO", "TIME", "COMMAND", "SCAN", "KEYS", "RANDOMKEY", "AUTH",
+		"READONLY", "READWRITE", "WAIT", "SLOWLOG", "LASTSAVE", "SAVE", "BGSAVE")
+	add(keysBetween(0, 0, 1),
+		"GET", "SET", "SETNX", "SETEX", "PSETEX", "GETSET", "GETDEL", "GETEX",
+		"APPEND", "STRLEN", "INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT",
+		"GETRANGE", "SETRANGE", "SUBSTR", "GETBIT", "SETBIT", "BITCOUNT", "BITPOS",
+		"BITFIELD", "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "TTL", "PTTL",
+		"PERSIST", "TYPE", "DUMP", "RESTORE",
+		"HSET", "HSETNX", "HGET", "HMSET", "HMGET", "HDEL", "HEXISTS", "HGETALL",
+		"HKEYS", "HVALS", "HLEN", "HINCRBY", "HINCRBYFLOAT", "HSTRLEN", "HSCAN",
+		"HRANDFIELD",
+		"LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LPOP", "RPOP", "LRANGE", "LINDEX",
+		"LSET", "LLEN", "LREM", "LTRIM", "LINSERT", "LPOS",
+		"SADD", "SREM", "SMEMBERS", "SISMEMBER", "SMISMEMBER", "SCARD", "SPOP",
+		"SRANDMEMBER", "SSCAN",
+		"ZADD", "ZREM", "ZSCORE", "ZMSCORE", "ZINCRBY", "ZCARD", "ZCOUNT", "ZRANGE",
+		"ZRANGEBYSCORE", "ZREVRANGE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX",
+		"ZREVRANGEBYLEX", "ZRANK", "ZREVRANK", "ZREMRANGEBYRANK",
+		"ZREMRANGEBYSCORE", "ZREMRANGEBYLEX", "ZLEXCOUNT", "ZPOPMIN", "ZPOPMAX",
+		"ZSCAN", "ZRANDMEMBER",
+		"XADD", "XLEN", "XRANGE", "XREVRANGE", "XDEL", "XTRIM", "XACK", "XPENDING",
+		"XCLAIM", "XAUTOCLAIM", "XSETID",
+		"PFADD", "GEOADD", "GEOPOS", "GEODIST", "GEOHASH", "GEOSEARCH",
+		"GEORADIUS_RO", "GEORADIUSBYMEMBER_RO")
+	add(keysBetween(1, 1, 1), "OBJECT", "XGROUP", "XINFO")
+	add(keysBetween(0, 1, 1), "RENAME", "RENAMENX", "RPOPLPUSH", "LMOVE",
+		"SMOVE", "COPY", "BRPOPLPUSH", "BLMOVE", "GEOSEARCHSTORE", "ZRANGESTORE")
+	add(keysBetween(0, -1, 1), "DEL", "UNLINK", "EXISTS", "MGET", "WATCH",
+		"TOUCH", "SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE",
+		"SDIFFSTORE", "PFCOUNT", "PFMERGE")
+	add(keysBetween(0, -2, 1), "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX")
+	add(keysBetween(0, -1, 2), "MSET", "MSETNX")
+	add(keysBetween(1, -1, 1), "BITOP")
+	add(keysCounted(0, 0), "ZUNION", "ZINTER", "ZDIFF", "SINTERCARD", "ZINTERCARD")
+	add(keysCounted(1, 0), "ZUNIONSTORE", "ZINTERSTORE", "ZDIFFSTORE")
+	add(keysCounted(1, 1), "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO")
+	add(keysAfterStreams, "XREAD", "XREADGROUP")
+	add(keysStored(5), "GEORADIUS")
+	add(keysStored(4), "GEORADIUSBYMEMBER")
+	add(sortKeys, "SORT", "SORT_RO")
+	return commands
+}()
+
+// keyIndexes returns the indexes of the keys among the n arguments of a
+// command, arg returning the argument at an index. It returns false for
+// commands it doesn't know the keys of, or whose arguments leave them
+// unknown.
+func keyIndexes(command string, n int, arg func(int) string) ([]int, bool) {
+	finder, ok := commandKeys[command]
+	if !ok {
+		return nil, false
+	}
+	return finder(n, arg)
+}
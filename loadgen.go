@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// conn is a connection the load generator issues commands over.
+type conn interface {
+	Send(commandName string, args ...interface{}) error
+	Flush() error
+	Receive() (interface{}, error)
+	Close() error
+}
+
+// dialFunc dials the connection at index among the connections of a stage.
+type dialFunc func(index int) (conn, error)
+
+type loadOptions struct {
+	workers     int
+	connections int
+	pipelined   int
+	duration    time.Duration
+	// warmup runs before duration. Requests issued during it are neither
+	// counted nor recorded, only their errors are.
+	warmup time.Duration
+	// requests stops the stage after that many measured requests, whichever
+	// of it and duration comes first. Zero means no limit.
+	requests uint64
+	workload *workload
+	// seed seeds the first worker's generator, every further worker gets
+	// the next seed so runs with the same seed issue the same commands.
+	seed int64
+}
+
+type loadStats struct {
+	requests     uint64
+	errors       uint64
+	warmupErrors uint64
+	// bytes counts the value bytes written and the bulk reply bytes read.
+	bytes   uint64
+	elapsed time.Duration
+}
+
+func (s *loadStats) throughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.requests) / s.elapsed.Seconds()
+}
+
+func (s *loadStats) bytesThroughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.bytes) / s.elapsed.Seconds()
+}
+
+// add accounts for replies received either while warming up or measuring.
+func (s *loadStats) add(requests uint64, errors uint64, bytes uint64, warmup bool) {
+	if warmup {
+		atomic.AddUint64(&s.warmupErrors, errors)
+		return
+	}
+	atomic.AddUint64(&s.requests, requests)
+	atomic.AddUint64(&s.errors, errors)
+	atomic.AddUint64(&s.bytes, bytes)
+}
+
+func (s *loadStats) String() string {
+	return fmt.Sprintf("%d requests in %s, %d errors, %d warm-up errors\nRequests/sec:\t%.2f\nTransfer/sec:\t%s", s.requests, s.elapsed, s.errors, s.warmupErrors, s.throughput(), formatBytes(s.bytesThroughput()))
+}
+
+// dialConnections opens every connection up front so connection establishment
+// isn't part of the measured run.
+func dialConnections(dial dialFunc, count int) ([]conn, error) {
+	conns := make([]conn, 0, count)
+	for i := 0; i < count; i++ {
+		c, err := dial(i)
+		if err != nil {
+			closeConnections(conns)
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
+
+func closeConnections(conns []conn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// partitionConnections spreads connections across workers round robin.
+func partitionConnections(conns []conn, workers int) [][]conn {
+	if workers > len(conns) {
+		workers = len(conns)
+	}
+	partitions := make([][]conn, workers)
+	for i, c := range conns {
+		partitions[i%workers] = append(partitions[i%workers], c)
+	}
+	return partitions
+}
+
+// stage is the state shared by the workers of one load generator run.
+type stage struct {
+	opts         loadOptions
+	start        time.Time
+	measureStart time.Time
+	deadline     time.Time
+	issued       uint64
+	// keyPosition is where the stage's generators are in the keyspace
+	// for the sequential key distribution.
+	keyPosition int64
+	stats       *loadStats
+}
+
+func newStage(opts loadOptions) *stage {
+	s := &stage{
+		opts:  opts,
+		start: time.Now(),
+		stats: &loadStats{},
+	}
+	s.measureStart = s.start.Add(opts.warmup)
+	s.deadline = s.measureStart.Add(opts.duration)
+	if opts.duration <= 0 {
+		// Only the request count bounds the stage.
+		s.deadline = s.measureStart.Add(math.MaxInt64)
+	}
+	return s
+}
+
+func (s *stage) warmingUp(now time.Time) bool {
+	return now.Before(s.measureStart)
+}
+
+// take reserves up to n of the measured requests the stage may still issue
+// and returns how many were granted. Warm-up requests aren't limited.
+func (s *stage) take(n int, warmup bool) int {
+	if s.opts.requests == 0 || warmup {
+		return n
+	}
+	issued := atomic.AddUint64(&s.issued, uint64(n))
+	if issued <= s.opts.requests {
+		return n
+	}
+	over := issued - s.opts.requests
+	if over >= uint64(n) {
+		return 0
+	}
+	return n - int(over)
+}
+
+func (s *stage) finish() {
+	s.stats.elapsed = time.Since(s.measureStart)
+}
+
+// runClosedLoop drives the target as fast as it will respond. Each worker owns
+// a share of the connections and keeps exactly one pipelined batch outstanding
+// on each of them until the duration expires or the requests run out.
+func runClosedLoop(dial dialFunc, opts loadOptions) (*loadStats, error) {
+	conns, err := dialConnections(dial, opts.connections)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConnections(conns)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	s := newStage(opts)
+	for index, partition := range partitionConnections(conns, opts.workers) {
+		wg.Add(1)
+		go func(seed int64, partition []conn) {
+			defer wg.Done()
+			if err := closedLoopWorker(s, partition, newGenerator(s, seed)); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(opts.seed+int64(index), partition)
+	}
+	wg.Wait()
+	s.finish()
+
+	return s.stats, firstErr
+}
+
+func closedLoopWorker(s *stage, conns []conn, g *generator) error {
+	sent := make([]int, len(conns))
+	// replies holds how many replies each command sent on a connection
+	// takes.
+	replies := make([][]int, len(conns))
+
+	for {
+		now := time.Now()
+		if !now.Before(s.deadline) {
+			return nil
+		}
+		warmup := s.warmingUp(now)
+
+		var total int
+		for index, c := range conns {
+			sent[index] = s.take(s.opts.pipelined, warmup)
+			if sent[index] == 0 {
+				continue
+			}
+			replies[index] = replies[index][:0]
+			for i := 0; i < sent[index]; i++ {
+				command, commandName, args := g.next()
+				n, err := g.send(c, commandName, args, g.workload.commands[command].followUp)
+				if err != nil {
+					return err
+				}
+				replies[index] = append(replies[index], n)
+			}
+			if err := c.Flush(); err != nil {
+				return err
+			}
+			total += sent[index]
+		}
+		if total == 0 {
+			return nil
+		}
+
+		errors, bytes := uint64(0), g.takeBytes()
+		for index, c := range conns {
+			for _, n := range replies[index] {
+				reply, err := receiveCommand(c, n)
+				if err != nil {
+					if _, ok := err.(redis.Error); !ok {
+						return err
+					}
+					errors++
+				}
+				bytes += replyBytes(reply)
+			}
+		}
+		s.stats.add(uint64(total), errors, bytes, warmup)
+	}
+}
+
+// openLoopBatch is a pipelined batch in flight on one connection, commands
+// holds the workload index of every command in it and bytes the value bytes
+// it wrote.
+type openLoopBatch struct {
+	intended time.Time
+	commands []int
+	bytes    uint64
+	warmup   bool
+}
+
+// recording holds the latencies of a stage, overall and per command.
+type recording struct {
+	all       *histogram
+	byCommand map[string]*histogram
+}
+
+func newRecording(w *workload) *recording {
+	r := &recording{
+		all:       newLatencyHistogram(),
+		byCommand: make(map[string]*histogram),
+	}
+	for _, name := range w.commandNames() {
+		r.byCommand[name] = newLatencyHistogram()
+	}
+	return r
+}
+
+func (r *recording) merge(other *recording) {
+	r.all.merge(other.all)
+	for name, latencies := range other.byCommand {
+		if _, ok := r.byCommand[name]; !ok {
+			r.byCommand[name] = newLatencyHistogram()
+		}
+		r.byCommand[name].merge(latencies)
+	}
+}
+
+// runOpenLoop issues requests at a constant rate regardless of how quickly the
+// target responds, the way wrk2 does. Every pipelined batch has an intended
+// start time on a fixed schedule and latency is measured from that time rather
+// than from when the batch was actually written, so a target that stalls is
+// charged for every request it held up instead of hiding them (coordinated
+// omission).
+func runOpenLoop(dial dialFunc, opts loadOptions, rate int) (*loadStats, *recording, error) {
+	if rate <= 0 {
+		return nil, nil, fmt.Errorf("open loop rate must be positive, got %d", rate)
+	}
+
+	conns, err := dialConnections(dial, opts.connections)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeConnections(conns)
+
+	latencies := newRecording(opts.workload)
+	var workerLatencies []*recording
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+
+	s := newStage(opts)
+	for index, partition := range partitionConnections(conns, opts.workers) {
+		// Each worker takes a share of the rate proportional to the number
+		// of connections it owns and round robins batches across them.
+		workerRate := float64(rate) * float64(len(partition)) / float64(len(conns))
+		interval := time.Duration(float64(opts.pipelined) / workerRate * float64(time.Second))
+
+		// The receivers of a worker share its histograms and the worker
+		// histograms are merged once the run is over.
+		recorder := newRecording(opts.workload)
+		workerLatencies = append(workerLatencies, recorder)
+
+		queues := make([]chan openLoopBatch, len(partition))
+		for i, c := range partition {
+			queues[i] = make(chan openLoopBatch, openLoopQueueDepth)
+			wg.Add(1)
+			go func(c conn, queue <-chan openLoopBatch) {
+				defer wg.Done()
+				if err := openLoopReceiver(s, c, queue, recorder); err != nil {
+					setErr(err)
+				}
+			}(c, queues[i])
+		}
+
+		wg.Add(1)
+		go func(seed int64, partition []conn, queues []chan openLoopBatch) {
+			defer wg.Done()
+			if err := openLoopScheduler(s, partition, queues, interval, newGenerator(s, seed)); err != nil {
+				setErr(err)
+			}
+		}(opts.seed+int64(index), partition, queues)
+	}
+	wg.Wait()
+	s.finish()
+
+	for _, recorder := range workerLatencies {
+		latencies.merge(recorder)
+	}
+	return s.stats, latencies, firstErr
+}
+
+// openLoopQueueDepth bounds how many batches may be outstanding on a single
+// connection before the scheduler waits for the receiver to catch up.
+const openLoopQueueDepth = 1024
+
+func openLoopScheduler(s *stage, conns []conn, queues []chan openLoopBatch, interval time.Duration, g *generator) error {
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+	}()
+
+	for batch := 0; ; batch++ {
+		intended := s.start.Add(time.Duration(batch) * interval)
+		if !intended.Before(s.deadline) {
+			return nil
+		}
+		warmup := s.warmingUp(intended)
+		size := s.take(s.opts.pipelined, warmup)
+		if size == 0 {
+			return nil
+		}
+		if wait := intended.Sub(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		index := batch % len(conns)
+		c := conns[index]
+		commands := make([]int, size)
+		for i := range commands {
+			var commandName string
+			var args []interface{}
+			commands[i], commandName, args = g.next()
+			if _, err := g.send(c, commandName, args, g.workload.commands[commands[i]].followUp); err != nil {
+				return err
+			}
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		queues[index] <- openLoopBatch{intended: intended, commands: commands, bytes: g.takeBytes(), warmup: warmup}
+	}
+}
+
+// openLoopReceiver reads the replies of every batch the scheduler sends. The
+// latency of a warm-up batch is discarded and only its errors are kept.
+func openLoopReceiver(s *stage, c conn, queue <-chan openLoopBatch, latencies *recording) error {
+	// Resolve the per command histograms and reply counts once rather than
+	// per reply.
+	byIndex := make([]*histogram, len(s.opts.workload.commands))
+	replies := make([]int, len(s.opts.workload.commands))
+	for i, command := range s.opts.workload.commands {
+		byIndex[i] = latencies.byCommand[command.name]
+		replies[i] = 1
+		if command.followUp != nil {
+			replies[i] = 2
+		}
+	}
+
+	var failed error
+	for batch := range queue {
+		if failed != nil {
+			// Keep draining so the scheduler never blocks on a dead connection.
+			continue
+		}
+		bytes := batch.bytes
+		for _, command := range batch.commands {
+			var errors uint64
+			reply, err := receiveCommand(c, replies[command])
+			if err != nil {
+				if _, ok := err.(redis.Error); !ok {
+					failed = err
+					break
+				}
+				errors = 1
+			}
+			if !batch.warmup {
+				latency := time.Since(batch.intended)
+				latencies.all.recordLatency(latency)
+				byIndex[command].recordLatency(latency)
+			}
+			s.stats.add(1, errors, bytes+replyBytes(reply), batch.warmup)
+			bytes = 0
+		}
+	}
+	return failed
+}
@@ -6,10 +6,8 @@ import (
 	img "image"
 	"image/color"
 	"math"
-	"os/exec"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -25,21 +23,78 @@ import (
 )
 
 type result struct {
-	name          string
-	latencyPoints plotter.XYs
-	throughput    float64
-	max           float64
+	name         string
+	latency      *histogram
+	throughput   float64
+	harnessBound bool
+	sweep        []sweepPoint
+
+	// bytesThroughput is the value bytes per second moved at throughput.
+	bytesThroughput float64
+	// populated holds the populate stage's stats when it ran.
+	populated *loadStats
+	// lag samples the consumer lag over a streams run.
+	lag []lagSample
+
+	sloSearched   bool
+	sloThroughput float64
+
+	// commandLatency breaks latency down by command when the workload
+	// mixes more than one.
+	commandLatency map[string]*histogram
+
+	trials []*result
 }
 
 var (
-	verbose = kingpin.Flag("verbose", "Verbose mode.").Short('v').Bool()
-	hosts   = kingpin.Flag("hosts", "Host addresses for the target Redis servers to benchmark against.").Required().String()
-	image   = kingpin.Flag("image", "Where to store the results graph in PNG format.").Default("results.jpg").String()
-	// requests    = kingpin.Flag("requests", "Number of total requests.").Default("10000000").Uint32()
-	connections = kingpin.Flag("connections", "Number of Redis client connections.").Default("128").Uint16()
-	pipelined   = kingpin.Flag("pipelined", "Number of pipelined requests per connection.").Default("1").Uint16()
-	sleep       = kingpin.Flag("sleep", "Duration in seconds to sleep between benchmarks.").Default("0").Uint16()
-	duration    = kingpin.Flag("duration", "Duration in seconds to run benchmark stages.").Default("10").Uint16()
+	verbose       = kingpin.Flag("verbose", "Verbose mode.").Short('v').Bool()
+	hosts         = kingpin.Flag("hosts", "Host addresses for the target Redis servers to benchmark against.").Required().String()
+	image         = kingpin.Flag("image", "Where to store the results graph in PNG format.").Default("results.jpg").String()
+	connections   = kingpin.Flag("connections", "Number of Redis client connections, a comma separated list runs a matrix.").Default("128").String()
+	pipelined     = kingpin.Flag("pipelined", "Number of pipelined requests per connection, a comma separated list runs a matrix.").Default("1").String()
+	sleep         = kingpin.Flag("sleep", "Duration in seconds to sleep between benchmarks.").Default("0").Uint16()
+	duration      = kingpin.Flag("duration", "Duration in seconds to run benchmark stages, 10 unless --requests is given.").Uint16()
+	requests      = kingpin.Flag("requests", "Number of requests each stage issues per target, stopping at whichever of it and --duration comes first.").Uint64()
+	warmup        = kingpin.Flag("warmup", "Duration in seconds each stage runs before measuring, its samples are discarded but its errors reported.").Default("0").Uint16()
+	protocol      = kingpin.Flag("protocol", "Protocol the load generator speaks, resp to Redis directly or http through the legacy HTTP shim.").Default("resp").Enum("resp", "http")
+	calibrate     = kingpin.Flag("calibrate", "Measure the HTTP shim against a no-op backend before benchmarking in http mode.").Default("true").Bool()
+	harnessMargin = kingpin.Flag("harness-margin", "Fraction of the HTTP shim's throughput ceiling within which a target is flagged as harness-bound.").Default("0.1").Float64()
+	sweep         = kingpin.Flag("sweep", "Comma separated rates to additionally run the latency stage at, either percentages of the measured max throughput (10%,50%,100%) or absolute requests/sec.").String()
+	sloLatency    = kingpin.Flag("slo-latency", "Latency threshold such as 2ms, setting it searches for the max throughput that keeps --slo-percentile within it.").Duration()
+	sloPercentile = kingpin.Flag("slo-percentile", "Percentile the latency SLO applies to.").Default("99").Float64()
+	sloIterations = kingpin.Flag("slo-iterations", "Number of bisection steps the SLO search takes.").Default("8").Uint16()
+	repeat        = kingpin.Flag("repeat", "Number of trials to run per target, interleaving targets in a randomized order.").Default("1").Uint16()
+	parallel      = kingpin.Flag("parallel", "Benchmark every host at the same time instead of one after another.").Bool()
+	mix           = kingpin.Flag("mix", "Weighted command mix the load generator issues, such as GET:80,SET:18,DEL:2.").Default("SET:100").String()
+	workers       = kingpin.Flag("workers", "Number of load generator workers the connections are spread across.").Default("4").Uint16()
+
+	keys               = kingpin.Flag("keys", "Key popularity distribution, uniform, zipf, hotspot or sequential.").Default("uniform").Enum("uniform", "zipf", "hotspot", "sequential")
+	keyCount           = kingpin.Flag("key-count", "Number of distinct keys in the keyspace.").Default("1000001").Int64()
+	zipfSkew           = kingpin.Flag("zipf-skew", "Skew of the zipf key distribution.").Default("0.99").Float64()
+	hotspotKeyFraction = kingpin.Flag("hotspot-keys", "Fraction of the keyspace that is hot in the hotspot key distribution.").Default("0.2").Float64()
+	hotspotOpFraction  = kingpin.Flag("hotspot-ops", "Fraction of operations that go to the hot keys in the hotspot key distribution.").Default("0.8").Float64()
+	valueSize          = kingpin.Flag("value-size", "Size of the values written, fixed (100), a uniform range (100-4KB) or a weighted histogram (100:70,4KB:25,256KB:5).").Default("10").String()
+	workloadFile       = kingpin.Flag("workload", "JSON workload file describing the commands, keys, values and phases to run, falling back to the flags for anything it leaves out.").String()
+	template           = kingpin.Flag("template", "Built-in data structure workload to run in place of --mix, hash, list, set or zset.").Enum("hash", "list", "set", "zset")
+	collectionSize     = kingpin.Flag("collection-size", "Number of elements in each hash, list, set and sorted set.").Default("100").Int()
+	mode               = kingpin.Flag("mode", "What to benchmark, commands from the workload, pubsub delivery, streams consumer groups, WATCH/MULTI/EXEC transactions, a replayed --trace, or record to proxy traffic to the target into a --trace.").Default("commands").Enum("commands", "pubsub", "streams", "transactions", "replay", "record")
+	publishers         = kingpin.Flag("publishers", "Number of publisher connections in pubsub mode.").Default("4").Uint16()
+	subscribers        = kingpin.Flag("subscribers", "Number of subscriber connections in pubsub mode, spread across the channels.").Default("4").Uint16()
+	channels           = kingpin.Flag("channels", "Number of channels in pubsub mode.").Default("1").Uint16()
+	publishRate        = kingpin.Flag("publish-rate", "Messages or entries per second across all publishers or producers in pubsub and streams mode, as fast as possible when 0.").Default("0").Float64()
+	producers          = kingpin.Flag("producers", "Number of XADD producer connections in streams mode.").Default("4").Uint16()
+	consumers          = kingpin.Flag("consumers", "Number of consumer group connections in streams mode, spread across the streams.").Default("4").Uint16()
+	streams            = kingpin.Flag("streams", "Number of streams in streams mode.").Default("1").Uint16()
+	tracePath          = kingpin.Flag("trace", "JSONL command trace to replay in replay mode or write in record mode.").String()
+	listen             = kingpin.Flag("listen", "Address the proxy listens on in record mode.").Default(":6380").String()
+	hashKeysFlag       = kingpin.Flag("hash-keys", "Replace keys by a hash of them in the trace written in record mode.").Bool()
+	speed              = kingpin.Flag("speed", "Multiplier of the trace's own timing in replay mode, replaying as fast as possible when 0.").Default("0").Float64()
+	txRetries          = kingpin.Flag("tx-retries", "Number of times a transaction is retried after an abort in transactions mode before it fails.").Default("100").Uint16()
+	keyspacesFlag      = kingpin.Flag("keyspaces", "Comma separated keyspaces the connections are spread across, each a database optionally followed by a key prefix such as 1,2:tenant-a:.").String()
+	populateKeyspace   = kingpin.Flag("populate", "Fill the keyspace with a value for every key before the measured stages run.").Bool()
+	seed               = kingpin.Flag("seed", "Seed for the load generators' random numbers, the same seed issues the same commands.").Default("1").Int64()
+
+	significantDigits = kingpin.Flag("significant-digits", "Number of significant digits latencies are recorded with (1-5).").Default("3").Uint8()
 
 	shapes = []draw.GlyphDrawer{
 		draw.SquareGlyph{},
@@ -53,228 +108,430 @@ var (
 
 func main() {
 	kingpin.Parse()
+	if *significantDigits < 1 || *significantDigits > 5 {
+		kingpin.Fatalf("--significant-digits must be between 1 and 5, got %d", *significantDigits)
+	}
+	if *repeat < 1 {
+		kingpin.Fatalf("--repeat must be at least 1, got %d", *repeat)
+	}
+	if *sloPercentile <= 0 || *sloPercentile > 100 {
+		kingpin.Fatalf("--slo-percentile must be above 0 and at most 100, got %g", *sloPercentile)
+	}
 
-	pools = make(map[int64]*redis.Pool)
+	var err error
+	connectionCounts, err = parseCounts(*connections)
+	if err != nil {
+		kingpin.Fatalf("--connections: %s", err)
+	}
+	pipelineDepths, err = parseCounts(*pipelined)
+	if err != nil {
+		kingpin.Fatalf("--pipelined: %s", err)
+	}
+	if *workloadFile != "" {
+		workloadPhases, err = loadWorkloadFile(*workloadFile)
+		if err != nil {
+			kingpin.Fatalf("--workload: %s", err)
+		}
+	} else {
+		flagged, err := flagWorkload()
+		if err != nil {
+			kingpin.Fatalf("%s", err)
+		}
+		workloadPhases = []*workload{flagged}
+	}
+	activeWorkload = workloadPhases[0]
+	if *protocol == "http" {
+		for _, w := range workloadPhases {
+			for _, command := range w.commands {
+				if command.dataType != "string" {
+					kingpin.Fatalf("%s can't go through the http shim, which only carries a key and a value", command.name)
+				}
+			}
+		}
+	}
+	if *mode != "commands" {
+		if *protocol != "resp" {
+			kingpin.Fatalf("--mode=%s needs --protocol=resp", *mode)
+		}
+		if isMatrix() || *sweep != "" || *sloLatency > 0 {
+			kingpin.Fatalf("--mode=%s can't be combined with a matrix, --sweep or --slo-latency", *mode)
+		}
+	}
+	if *mode == "pubsub" || *mode == "streams" || *mode == "record" {
+		for _, w := range workloadPhases {
+			if len(w.keyspaces) > 1 || w.keyspaces[0] != (keyspace{}) {
+				kingpin.Fatalf("--mode=%s doesn't use keyspaces", *mode)
+			}
+		}
+	}
+	if *mode == "pubsub" {
+		if *publishers == 0 || *subscribers == 0 || *channels == 0 {
+			kingpin.Fatalf("--publishers, --subscribers and --channels must be at least 1")
+		}
+		if *subscribers < *channels {
+			kingpin.Fatalf("every channel needs a subscriber, got %d --subscribers for %d --channels", *subscribers, *channels)
+		}
+	}
+	if *mode == "streams" {
+		if *producers == 0 || *consumers == 0 || *streams == 0 {
+			kingpin.Fatalf("--producers, --consumers and --streams must be at least 1")
+		}
+		if *consumers < *streams {
+			kingpin.Fatalf("every stream needs a consumer, got %d --consumers for %d --streams", *consumers, *streams)
+		}
+	}
+	if *mode == "replay" {
+		if *tracePath == "" {
+			kingpin.Fatalf("--mode=replay needs a --trace")
+		}
+		if *speed < 0 {
+			kingpin.Fatalf("--speed must not be negative, got %g", *speed)
+		}
+		activeTrace, err = loadTrace(*tracePath, connectionCounts[0])
+		if err != nil {
+			kingpin.Fatalf("--trace: %s", err)
+		}
+	}
+	if len(workloadPhases) > 1 && isMatrix() {
+		kingpin.Fatalf("--workload phases can't be combined with a --connections or --pipelined matrix")
+	}
+	if *sweep != "" && isMatrix() {
+		kingpin.Fatalf("--sweep can't be combined with a --connections or --pipelined matrix")
+	}
+	if *sloLatency > 0 && isMatrix() {
+		kingpin.Fatalf("--slo-latency can't be combined with a --connections or --pipelined matrix")
+	}
+	if *repeat > 1 && isMatrix() {
+		kingpin.Fatalf("--repeat can't be combined with a --connections or --pipelined matrix")
+	}
+	sweepRates, err = parseSweepRates(*sweep)
+	if err != nil {
+		kingpin.Fatalf("--sweep: %s", err)
+	}
 
-	startHTTPServers()
+	targets := parseTargets()
+	if *mode == "record" {
+		if *tracePath == "" || len(targets) != 1 {
+			kingpin.Fatalf("--mode=record needs a --trace to write and a single host to proxy to")
+		}
+		runRecord(targets[0])
+		return
+	}
+	if *protocol == "http" {
+		pools = make(map[int64]map[int]*redis.Pool)
+		startHTTPServers(targets)
+		if *calibrate {
+			startNoopHTTPServer(calibrationTarget.httpPort)
+		}
+	}
 	time.Sleep(time.Duration(*sleep) * time.Second)
-	benchmark()
+	if isMatrix() {
+		benchmarkMatrix(targets)
+	} else {
+		benchmark(targets)
+	}
 }
 
-func startHTTPServers() {
-	addresses := strings.Split(*hosts, ",")
-	httpPort := httpBasePort
-
-	for _, address := range addresses {
-		httpPort++
-		var offset = 0
-		var name string
-
-		hostParts := strings.Split(address, ":")
-		if len(hostParts) > 2 {
-			offset = 1
-			name = hostParts[0]
-		} else {
-			name = hostParts[0] + " " + hostParts[1]
-		}
-		host := hostParts[0+offset]
-		port := hostParts[1+offset]
-
-		listenAddress := fmt.Sprintf("%s:%s", host, port)
+func startHTTPServers(targets []target) {
+	for _, t := range targets {
 		if *verbose {
-			fmt.Printf("starting http server for %s listening on %d\n", name, httpPort)
+			fmt.Printf("starting http server for %s listening on %d\n", t.name, t.httpPort)
 		}
-		go startHTTPServer(listenAddress, int(*connections), httpPort)
+		startHTTPServer(t.address(), keyspaceDatabases(), maxCount(connectionCounts), t.httpPort)
 	}
 }
 
-func benchmark() {
+func benchmark(targets []target) {
 	start := time.Now()
 
-	httpPort := httpBasePort
 	var results []*result
-	addresses := strings.Split(*hosts, ",")
 
-	for index, address := range addresses {
-		var offset = 0
-		var name string
-		httpPort++
-
-		hostParts := strings.Split(address, ":")
-		if len(hostParts) > 2 {
-			offset = 1
-			name = hostParts[0]
-		} else {
-			name = hostParts[0] + " " + hostParts[1]
-		}
-		host := hostParts[0+offset]
-		port, _ := strconv.ParseInt(hostParts[1+offset], 10, 32)
-
-		r := &result{}
-		r.name = name
-
-		throughputOutput, err := runWrkThroughputBenchmark(name, host, int(port), httpPort)
+	var calibration *result
+	if *protocol == "http" && *calibrate {
+		var err error
+		calibration, err = runCalibration()
 		if err != nil {
 			fmt.Println(err)
-			fmt.Println(throughputOutput)
-		} else {
-			if *verbose {
-				fmt.Println(string(throughputOutput))
-			}
-			parseWrkThroughputResults(name, throughputOutput, r)
-
 		}
+	}
 
-		latencyOutput, err := runWrkLatencyBenchmark(name, host, int(port), httpPort, int(r.throughput))
-		if err != nil {
-			fmt.Println(err)
-			fmt.Println(latencyOutput)
-		} else {
-			if *verbose {
-				fmt.Println(string(latencyOutput))
-			}
-
-			parseWrkLatencyResults(name, latencyOutput, r)
-			results = append(results, r)
-
-			if len(addresses) > 1 && index < len(addresses)-1 && *sleep > 0 {
-				time.Sleep(time.Duration(*sleep) * time.Second)
-			}
+	for _, phase := range workloadPhases {
+		activeWorkload = phase
+		if *verbose && phase.name != "" {
+			fmt.Printf("Running phase %s\n", phase.name)
 		}
+		results = append(results, benchmarkPhase(targets)...)
 	}
+	activeWorkload = workloadPhases[0]
 	elapsed := time.Since(start)
 
+	printPopulations(results)
+	printThroughputs(results)
+	printTrialSummaries(results)
+	printCommandLatencies(results)
+
+	if calibration != nil {
+		flagHarnessBound(results, calibration)
+		printCalibration(results, calibration)
+		results = append(results, calibration)
+	}
+
 	generateLatencyDistributionGraph(results)
 	generateThroughputGraph(results)
 	generateMaxLatencyGraph(results)
-	combineImages()
+
+	files := []string{"results_latency.png", "results_throughput.png", "results_max.png"}
+	if len(sweepRates) > 0 {
+		generateSweepGraph(results)
+		files = append(files, "results_sweep.png")
+	}
+	if *mode == "streams" {
+		generateLagGraph(results)
+		files = append(files, "results_lag.png")
+	}
+	combineImages(files)
 
 	url, err := postToImgur(*image)
 	if err != nil {
 		fmt.Println(err)
 	}
-	fmt.Printf("%d/%d took %s: ![](%s)\n", *connections, *pipelined, elapsed, url)
+	fmt.Printf("%d/%d took %s: ![](%s)\n", connectionCounts[0], pipelineDepths[0], elapsed, url)
+}
+
+// benchmarkPhase runs the trials, sweep and SLO search of the active workload
+// against every target and returns the results of the targets that completed.
+func benchmarkPhase(targets []target) []*result {
+	trialResults := make([]*result, len(targets))
+	for index, t := range targets {
+		trialResults[index] = &result{name: phaseResultName(t.name)}
+	}
+	if err := loadScripts(targets); err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	populate(targets, trialResults)
+	runTrials(targets, trialResults)
+
+	var completed []int
+	for index, r := range trialResults {
+		if len(r.trials) > 0 {
+			completed = append(completed, index)
+		}
+	}
+
+	eachTarget(completed, func(index int) {
+		t, r := targets[index], trialResults[index]
+		if len(sweepRates) > 0 {
+			if err := runSweep(t, r); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if sloEnabled() {
+			if err := runSLOSearch(t, r); err != nil {
+				fmt.Println(err)
+			}
+		}
+	})
+
+	var results []*result
+	for _, index := range completed {
+		results = append(results, trialResults[index])
+	}
+	return results
 }
 
-func runWrkThroughputBenchmark(name string, host string, redisPort int, httpPort int) (string, error) {
-	connectionsArg := strconv.FormatUint(uint64(*connections), 10)
-	pipelinedArg := strconv.FormatUint(uint64(*pipelined), 10)
+// phaseResultName names a target's result after the active phase when the
+// workload has more than one.
+func phaseResultName(name string) string {
+	if len(workloadPhases) < 2 {
+		return name
+	}
+	phase := activeWorkload.name
+	if phase == "" {
+		for index, w := range workloadPhases {
+			if w == activeWorkload {
+				phase = strconv.Itoa(index + 1)
+			}
+		}
+	}
+	return name + " " + phase
+}
 
-	if *verbose {
-		fmt.Printf("Running benchmark for %s on %s:%d\n\tConnections:\t%s\n\tPipelined:\t%s\n", name, host, redisPort, connectionsArg, pipelinedArg)
-	}
-
-	cmd := exec.Command(
-		"./benchmark/wrk",
-		"--latency",
-		"--script",
-		"./benchmark/set_random.lua",
-		"--threads",
-		"4",
-		"--connections",
-		connectionsArg,
-		"--duration",
-		fmt.Sprintf("%ds", *duration),
-		fmt.Sprintf("http://localhost:%d", httpPort),
-		"--",
-		pipelinedArg)
-
-	output, err := cmd.Output()
-	return string(output), err
+// defaultDuration is how long a stage runs when neither --duration nor
+// --requests bound it.
+const defaultDuration = 10 * time.Second
+
+// stageOptions are the load generator settings every stage runs with.
+func stageOptions() loadOptions {
+	opts := loadOptions{
+		workers:     int(*workers),
+		connections: connectionCounts[0],
+		pipelined:   pipelineDepths[0],
+		duration:    time.Duration(*duration) * time.Second,
+		warmup:      time.Duration(*warmup) * time.Second,
+		requests:    *requests,
+		workload:    activeWorkload,
+		seed:        activeWorkload.seed,
+	}
+	if activeWorkload.duration > 0 || activeWorkload.requests > 0 {
+		opts.duration = activeWorkload.duration
+		opts.requests = activeWorkload.requests
+	}
+	if opts.duration == 0 && opts.requests == 0 {
+		opts.duration = defaultDuration
+	}
+	return opts
 }
 
-func runWrkLatencyBenchmark(name string, host string, redisPort int, httpPort int, rate int) (string, error) {
-	connectionsArg := strconv.FormatUint(uint64(*connections), 10)
-	pipelinedArg := strconv.FormatUint(uint64(*pipelined), 10)
+func runThroughputBenchmark(t target, opts loadOptions, r *result) error {
+	if *verbose {
+		fmt.Printf("Running benchmark for %s on %s over %s\n\tConnections:\t%d\n\tPipelined:\t%d\n", t.name, t.address(), *protocol, opts.connections, opts.pipelined)
+	}
 
+	stats, err := runClosedLoop(t.dial, opts)
+	if err != nil {
+		return err
+	}
 	if *verbose {
-		fmt.Printf("Running benchmark for %s on %s:%d\n\tConnections:\t%s\n\tPipelined:\t%s\n", name, host, redisPort, connectionsArg, pipelinedArg)
-	}
-
-	cmd := exec.Command(
-		"./benchmark/wrk2",
-		"--latency",
-		"--script",
-		"./benchmark/set_random.lua",
-		"--threads",
-		"4",
-		"--connections",
-		connectionsArg,
-		"--duration",
-		fmt.Sprintf("%ds", *duration),
-		"--rate",
-		strconv.Itoa(rate),
-		fmt.Sprintf("http://localhost:%d", httpPort),
-		"--",
-		pipelinedArg)
-
-	output, err := cmd.Output()
-	return string(output), err
+		fmt.Println(stats)
+	} else {
+		reportErrors(t, stats)
+	}
+	r.throughput = stats.throughput()
+	r.bytesThroughput = stats.bytesThroughput()
+	return nil
 }
 
-func parseWrkThroughputResults(name string, results string, r *result) {
-	lines := strings.Split(results, "\n")
+func runLatencyBenchmark(t target, opts loadOptions, rate int, r *result) error {
+	if *verbose {
+		fmt.Printf("Running benchmark for %s on %s over %s\n\tConnections:\t%d\n\tPipelined:\t%d\n\tRate:\t\t%d\n", t.name, t.address(), *protocol, opts.connections, opts.pipelined, rate)
+	}
 
-	for i := 0; i < len(lines); i++ {
-		line := lines[i]
-		if strings.HasPrefix(line, "Requests/sec:") {
-			throughputStringParts := strings.Fields(lines[i])
-			throughput, _ := strconv.ParseFloat(throughputStringParts[1], 64)
-			r.throughput = throughput
-			break
-		}
+	stats, latencies, err := runOpenLoop(t.dial, opts, rate)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Println(stats)
+	} else {
+		reportErrors(t, stats)
+	}
+	r.latency = latencies.all
+	r.commandLatency = latencies.byCommand
+	if *verbose {
+		printLatencyDistribution(r.latency)
 	}
+	return nil
 }
 
-func parseWrkLatencyResults(name string, results string, r *result) {
-	var lastResult float64
-	startResults := false
-	endResults := false
+// reportErrors prints any errors a stage hit, including those during the
+// warm-up whose samples were otherwise discarded.
+func reportErrors(t target, stats *loadStats) {
+	if stats.errors > 0 || stats.warmupErrors > 0 {
+		fmt.Printf("%s: %d errors, %d warm-up errors\n", t.name, stats.errors, stats.warmupErrors)
+	}
+}
 
-	entries := make(map[float64]float64)
-	lines := strings.Split(results, "\n")
+// latencyPercentiles are the percentiles wrk2 reports in its latency
+// distribution and that the latency graph plots.
+var latencyPercentiles = []float64{50, 75, 90, 99, 99.9, 99.99, 99.999, 100}
 
-	for i := 0; i < len(lines); i++ {
-		line := lines[i]
-		if strings.HasPrefix(line, " 50.") && startResults == false {
-			startResults = true
-		} else if line == "" && startResults == true {
-			endResults = true
-			break
-		}
-
-		if startResults && !endResults {
-			lineParts := strings.Fields(line)
-			percentileString := strings.Split(lineParts[0], "%")[0]
-			latencyString := strings.Split(lineParts[1], "ms")[0]
+// milliseconds converts a microsecond histogram value for display.
+func milliseconds(value int64) float64 {
+	return float64(value) / 1000
+}
 
-			percentile, _ := strconv.ParseFloat(percentileString, 64)
-			latency, _ := strconv.ParseFloat(latencyString, 64)
+func printLatencyDistribution(latencies *histogram) {
+	for _, percentile := range latencyPercentiles {
+		fmt.Printf("%8.3f%%\t%.3fms\n", percentile, milliseconds(latencies.valueAtPercentile(percentile)))
+	}
+	fmt.Printf("Mean: %.3fms, StdDev: %.3fms, Samples: %d\n", milliseconds(int64(latencies.mean())), milliseconds(int64(latencies.stdDev())), latencies.count())
+}
 
-			lastResult = latency
+// printThroughputs prints the max throughput of every target in requests, or
+// deliveries, appends or commits in the other modes, and in value bytes per
+// second.
+func printThroughputs(results []*result) {
+	unit := "requests/sec"
+	switch *mode {
+	case "pubsub":
+		unit = "delivered/sec"
+	case "streams":
+		unit = "appends/sec"
+	case "transactions":
+		unit = "commits/sec"
+	case "replay":
+		unit = "replayed/sec"
+	}
+	fmt.Printf("%-16s %14s %14s\n", "", unit, "transfer/sec")
+	for _, r := range results {
+		fmt.Printf("%-16s %14.2f %14s\n", r.name, r.throughput, formatBytes(r.bytesThroughput))
+	}
+}
 
-			if percentile >= 1 && latency >= 1 {
-				entries[percentile] = latency
+func printCommandLatencies(results []*result) {
+	for _, r := range results {
+		if len(r.commandLatency) < 2 {
+			continue
+		}
+		fmt.Printf("%s latency by command (milliseconds)\n", r.name)
+		fmt.Printf("%-14s", "")
+		for _, percentile := range latencyPercentiles {
+			fmt.Printf("%10s", fmt.Sprintf("p%g", percentile))
+		}
+		fmt.Println()
+		for _, name := range r.commandNames() {
+			fmt.Printf("%-14s", name)
+			for _, percentile := range latencyPercentiles {
+				fmt.Printf("%10.3f", milliseconds(r.commandLatency[name].valueAtPercentile(percentile)))
 			}
+			fmt.Println()
 		}
 	}
+}
 
-	points := make(plotter.XYs, len(entries))
+func percentilePoints(latencies *histogram) plotter.XYs {
+	points := make(plotter.XYs, len(latencyPercentiles))
+	for i, percentile := range latencyPercentiles {
+		points[i].X = percentile
+		points[i].Y = milliseconds(latencies.valueAtPercentile(percentile))
+	}
+	return points
+}
+
+func (r *result) latencyPoints() plotter.XYs {
+	return percentilePoints(r.latency)
+}
 
-	var keys []float64
-	for k := range entries {
-		keys = append(keys, k)
+// headlineThroughput is the max sustainable throughput under the latency SLO
+// when one was searched for, otherwise the closed-loop max throughput.
+func (r *result) headlineThroughput() float64 {
+	if r.sloSearched {
+		return r.sloThroughput
 	}
-	sort.Float64s(keys)
+	return r.throughput
+}
 
-	for i, k := range keys {
-		points[i].X = k
-		points[i].Y = entries[k]
+// label is how the result is named in graph legends.
+func (r *result) label() string {
+	if r.harnessBound {
+		return r.name + " (harness-bound)"
 	}
+	return r.name
+}
+
+// commandNames lists the commands the result has latencies for.
+func (r *result) commandNames() []string {
+	names := make([]string, 0, len(r.commandLatency))
+	for name := range r.commandLatency {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-	r.name = name
-	r.latencyPoints = points
-	r.max = lastResult
+func (r *result) max() float64 {
+	return milliseconds(r.latency.max())
 }
 
 func generateThroughputGraph(results []*result) {
@@ -283,13 +540,16 @@ func generateThroughputGraph(results []*result) {
 		panic(err)
 	}
 	p.Title.Text = "throughput"
+	if sloEnabled() {
+		p.Title.Text = "throughput with " + sloDescription()
+	}
 	p.Y.Label.Text = "operations/second (millions)"
 	p.Legend.Top = true
 
 	offsetPadding := -100.0
 
 	for index, r := range results {
-		value := plotter.Values{r.throughput / 1000000}
+		value := plotter.Values{r.headlineThroughput() / 1000000}
 		var bars *plotter.BarChart
 		width := vg.Points(40)
 		offset := vg.Points(float64(40*(index+1)) + offsetPadding)
@@ -303,7 +563,10 @@ func generateThroughputGraph(results []*result) {
 		bars.Offset = offset
 
 		p.Add(bars)
-		p.Legend.Add(r.name, bars)
+		p.Legend.Add(r.label(), bars)
+		if len(r.trials) > 1 && !r.sloSearched {
+			p.Add(newBarErrorBar(r.throughputSummary(), 1.0/1000000, offset))
+		}
 	}
 	p.NominalX("")
 
@@ -324,7 +587,10 @@ func generateMaxLatencyGraph(results []*result) {
 	offsetPadding := -100.0
 
 	for index, r := range results {
-		value := plotter.Values{r.max}
+		value := plotter.Values{r.max()}
+		if len(r.trials) > 1 {
+			value[0] = r.percentileSummary(100).mean
+		}
 		var bars *plotter.BarChart
 		width := vg.Points(40)
 		offset := vg.Points(float64(40*(index+1)) + offsetPadding)
@@ -338,7 +604,10 @@ func generateMaxLatencyGraph(results []*result) {
 		bars.Offset = offset
 
 		p.Add(bars)
-		p.Legend.Add(r.name, bars)
+		p.Legend.Add(r.label(), bars)
+		if len(r.trials) > 1 {
+			p.Add(newBarErrorBar(r.percentileSummary(100), 1, offset))
+		}
 	}
 	p.NominalX("")
 
@@ -352,7 +621,7 @@ func generateLatencyDistributionGraph(results []*result) {
 	if err != nil {
 		panic(err)
 	}
-	p.Title.Text = fmt.Sprintf("connections: %d, pipelined: %d", *connections, *pipelined)
+	p.Title.Text = fmt.Sprintf("connections: %d, pipelined: %d, protocol: %s", connectionCounts[0], pipelineDepths[0], *protocol)
 	p.BackgroundColor = color.White
 	p.Legend.Top = true
 	p.Legend.Left = true
@@ -373,8 +642,8 @@ func generateLatencyDistributionGraph(results []*result) {
 		// Make a line plotter with points and set its style.
 		var lpLine *plotter.Line
 		var lpPoints *plotter.Scatter
-		lpLine, lpPoints, err = plotter.NewLinePoints(r.latencyPoints)
-		//lpLine, _, err = plotter.NewLinePoints(r.latencyPoints)
+		lpLine, lpPoints, err = plotter.NewLinePoints(r.latencyPoints())
+		//lpLine, _, err = plotter.NewLinePoints(r.latencyPoints())
 		if err != nil {
 			panic(err)
 		}
@@ -387,7 +656,23 @@ func generateLatencyDistributionGraph(results []*result) {
 
 		// Add the plotters to the plot, with a legend entry for each
 		p.Add(lpLine, lpPoints)
-		p.Legend.Add(r.name, lpLine, lpPoints)
+		p.Legend.Add(r.label(), lpLine, lpPoints)
+
+		if len(r.commandLatency) < 2 {
+			continue
+		}
+		for commandIndex, name := range r.commandNames() {
+			var commandLine *plotter.Line
+			commandLine, err = plotter.NewLine(percentilePoints(r.commandLatency[name]))
+			if err != nil {
+				panic(err)
+			}
+			commandLine.Color = plotutil.Color(index)
+			commandLine.Dashes = plotutil.Dashes(commandIndex + 1)
+
+			p.Add(commandLine)
+			p.Legend.Add(r.label()+" "+name, commandLine)
+		}
 	}
 
 	// Save the plot to a PNG file.
@@ -457,10 +742,7 @@ func addCommas(s string) string {
 	return s
 }
 
-func combineImages() {
-	// Input files
-	files := []string{"results_latency.png", "results_throughput.png", "results_max.png"}
-
+func combineImages(files []string) {
 	// Load images
 	var images []img.Image
 	var width int
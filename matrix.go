@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/palette"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+)
+
+var (
+	connectionCounts []int
+	pipelineDepths   []int
+)
+
+// matrixResult holds one target's measurements for every combination of
+// --connections and --pipelined, indexed [connections][pipelined].
+type matrixResult struct {
+	name       string
+	throughput [][]float64
+	p99        [][]float64
+}
+
+// parseCounts parses a comma separated list of positive integers.
+func parseCounts(spec string) ([]int, error) {
+	var counts []int
+	for _, field := range strings.Split(spec, ",") {
+		count, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid count %q", field)
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+func maxCount(counts []int) int {
+	max := 0
+	for _, count := range counts {
+		if count > max {
+			max = count
+		}
+	}
+	return max
+}
+
+// isMatrix reports whether more than one connection count or pipeline depth
+// was asked for, in which case every combination is benchmarked.
+func isMatrix() bool {
+	return len(connectionCounts) > 1 || len(pipelineDepths) > 1
+}
+
+func newMatrix(rows int, columns int) [][]float64 {
+	matrix := make([][]float64, rows)
+	for i := range matrix {
+		matrix[i] = make([]float64, columns)
+		for j := range matrix[i] {
+			matrix[i][j] = math.NaN()
+		}
+	}
+	return matrix
+}
+
+func benchmarkMatrix(targets []target) {
+	start := time.Now()
+
+	if err := loadScripts(targets); err != nil {
+		fmt.Println(err)
+		return
+	}
+	populated := make([]*result, len(targets))
+	for index, t := range targets {
+		populated[index] = &result{name: t.name}
+	}
+	populate(targets, populated)
+
+	// The shim's ceiling is measured once, at the first combination, and
+	// printed for comparison with the heat maps.
+	if *protocol == "http" && *calibrate {
+		calibration, err := runCalibration()
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			printCalibration(nil, calibration)
+		}
+	}
+
+	results := make([]*matrixResult, len(targets))
+	indexes := make([]int, len(targets))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	eachTarget(indexes, func(index int) {
+		t := targets[index]
+		m := &matrixResult{
+			name:       t.name,
+			throughput: newMatrix(len(connectionCounts), len(pipelineDepths)),
+			p99:        newMatrix(len(connectionCounts), len(pipelineDepths)),
+		}
+
+		for ci, connectionCount := range connectionCounts {
+			for pi, pipelineDepth := range pipelineDepths {
+				opts := stageOptions()
+				opts.connections = connectionCount
+				opts.pipelined = pipelineDepth
+
+				r := &result{name: t.name}
+				if err := runThroughputBenchmark(t, opts, r); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				m.throughput[ci][pi] = r.throughput
+
+				if err := runLatencyBenchmark(t, opts, int(r.throughput), r); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				m.p99[ci][pi] = milliseconds(r.latency.valueAtPercentile(99))
+			}
+		}
+		results[index] = m
+
+		if !*parallel && index < len(targets)-1 && *sleep > 0 {
+			time.Sleep(time.Duration(*sleep) * time.Second)
+		}
+	})
+	elapsed := time.Since(start)
+
+	printPopulations(populated)
+
+	var files []string
+	for index, m := range results {
+		throughputFile := fmt.Sprintf("results_matrix_%d_throughput.png", index)
+		generateHeatMap(m.name+" throughput (thousands ops/sec)", m.throughput, 1.0/1000, throughputFile)
+		p99File := fmt.Sprintf("results_matrix_%d_p99.png", index)
+		generateHeatMap(m.name+" p99 latency (milliseconds)", m.p99, 1, p99File)
+		files = append(files, throughputFile, p99File)
+	}
+	combineImages(files)
+
+	url, err := postToImgur(*image)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("%s/%s took %s: ![](%s)\n", *connections, *pipelined, elapsed, url)
+}
+
+// matrixGrid lays a matrix out on a heat map with connections along the X
+// axis and pipeline depth along the Y axis. Cells are placed at their index
+// rather than their value so that uneven steps like 1,16,256 stay legible.
+type matrixGrid struct {
+	values [][]float64
+	scale  float64
+}
+
+func (g matrixGrid) Dims() (c, r int)   { return len(connectionCounts), len(pipelineDepths) }
+func (g matrixGrid) Z(c, r int) float64 { return g.values[c][r] * g.scale }
+func (g matrixGrid) X(c int) float64    { return float64(c) }
+func (g matrixGrid) Y(r int) float64    { return float64(r) }
+
+func countTicks(counts []int) plot.ConstantTicks {
+	ticks := make(plot.ConstantTicks, len(counts))
+	for i, count := range counts {
+		ticks[i] = plot.Tick{Value: float64(i), Label: strconv.Itoa(count)}
+	}
+	return ticks
+}
+
+func generateHeatMap(title string, values [][]float64, scale float64, filename string) {
+	p, err := plot.New()
+	if err != nil {
+		panic(err)
+	}
+	p.Title.Text = title
+	p.X.Label.Text = "connections"
+	p.Y.Label.Text = "pipelined"
+	p.X.Tick.Marker = countTicks(connectionCounts)
+	p.Y.Tick.Marker = countTicks(pipelineDepths)
+
+	grid := matrixGrid{values: values, scale: scale}
+	heatMap := plotter.NewHeatMap(grid, palette.Heat(12, 1))
+	if heatMap.Min >= heatMap.Max {
+		// A flat or empty matrix still needs a range to scale the palette.
+		if math.IsInf(heatMap.Min, 0) || math.IsNaN(heatMap.Min) {
+			heatMap.Min = 0
+		}
+		heatMap.Max = heatMap.Min + 1
+	}
+	p.Add(heatMap)
+
+	var labels plotter.XYLabels
+	for c := range connectionCounts {
+		for r := range pipelineDepths {
+			value := grid.Z(c, r)
+			if math.IsNaN(value) {
+				continue
+			}
+			labels.XYs = append(labels.XYs, struct{ X, Y float64 }{grid.X(c), grid.Y(r)})
+			labels.Labels = append(labels.Labels, strconv.FormatFloat(value, 'f', 1, 64))
+		}
+	}
+	if len(labels.Labels) > 0 {
+		var valueLabels *plotter.Labels
+		valueLabels, err = plotter.NewLabels(labels)
+		if err != nil {
+			panic(err)
+		}
+		p.Add(valueLabels)
+	}
+
+	if err = p.Save(4*vg.Inch, 4*vg.Inch, filename); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "sync"
+
+// eachTarget calls fn with every index, concurrently when --parallel is set
+// so that every target is under load at the same time, and one after another
+// otherwise.
+func eachTarget(indexes []int, fn func(index int)) {
+	if !*parallel {
+		for _, index := range indexes {
+			fn(index)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, index := range indexes {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			fn(index)
+		}(index)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// populatePipelined is the least number of SETs the populate stage pipelines
+// per connection, it only cares about getting the data in quickly.
+const populatePipelined = 64
+
+// runPopulate writes every key of the workload's keyspace once with a value
+// from its value sizes, or a full collection for the data structure types it
+// uses, so that reads in the measured stages hit. Workers claim chunks of
+// keys in order until none are left, printing progress every second.
+func runPopulate(name string, dial dialFunc, opts loadOptions) (*loadStats, error) {
+	conns, err := dialConnections(dial, opts.connections)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConnections(conns)
+
+	pipelined := opts.pipelined
+	if pipelined < populatePipelined {
+		pipelined = populatePipelined
+	}
+	dataTypes := opts.workload.dataTypes()
+	keyCount := opts.workload.keys.size()
+	total := keyCount * int64(len(dataTypes))
+
+	var next int64
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				written := atomic.LoadInt64(&next)
+				if written > total {
+					written = total
+				}
+				fmt.Printf("Populating %s: %d/%d keys (%.0f%%)\n", name, written, total, 100*float64(written)/float64(total))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s := newStage(opts)
+	for index, partition := range partitionConnections(conns, opts.workers) {
+		wg.Add(1)
+		go func(seed int64, partition []conn) {
+			defer wg.Done()
+			if err := populateWorker(s, partition, pipelined, dataTypes, keyCount, &next, newGenerator(s, seed)); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(opts.seed+int64(index), partition)
+	}
+	wg.Wait()
+	close(done)
+	s.finish()
+
+	return s.stats, firstErr
+}
+
+// populateWorker writes keys in the order of the data types, every key of
+// the first type, then of the second and so on.
+func populateWorker(s *stage, conns []conn, pipelined int, dataTypes []string, keyCount int64, next *int64, g *generator) error {
+	// replies holds how many replies each command sent on a connection
+	// takes.
+	replies := make([][]int, len(conns))
+	total := keyCount * int64(len(dataTypes))
+
+	for {
+		var batch int
+		for index, c := range conns {
+			first := atomic.AddInt64(next, int64(pipelined)) - int64(pipelined)
+			replies[index] = replies[index][:0]
+			for key := first; key < first+int64(pipelined) && key < total; key++ {
+				commandName, args := g.fillCommand(dataTypes[key/keyCount], key%keyCount)
+				definition, _ := lookupCommand(commandName)
+				n, err := g.send(c, commandName, args, definition.followUp)
+				if err != nil {
+					return err
+				}
+				replies[index] = append(replies[index], n)
+			}
+			if len(replies[index]) == 0 {
+				continue
+			}
+			if err := c.Flush(); err != nil {
+				return err
+			}
+			batch += len(replies[index])
+		}
+		if batch == 0 {
+			return nil
+		}
+
+		var errors uint64
+		for index, c := range conns {
+			for _, n := range replies[index] {
+				if _, err := receiveCommand(c, n); err != nil {
+					if _, ok := err.(redis.Error); !ok {
+						return err
+					}
+					errors++
+				}
+			}
+		}
+		s.stats.add(uint64(batch), errors, g.takeBytes(), false)
+	}
+}
+
+// populate fills the keyspace of the active workload on every target before
+// its trials run, when the workload asks for it. Every database and prefix
+// the workload's keyspaces name is filled in turn.
+func populate(targets []target, results []*result) {
+	if !activeWorkload.populate {
+		return
+	}
+
+	indexes := make([]int, len(targets))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	eachTarget(indexes, func(index int) {
+		t, r := targets[index], results[index]
+		opts := stageOptions()
+		opts.warmup = 0
+		stats := &loadStats{}
+		for _, ks := range activeWorkload.keyspaces {
+			name := r.name
+			if len(activeWorkload.keyspaces) > 1 {
+				name = fmt.Sprintf("%s keyspace %s", r.name, ks)
+			}
+			filled, err := runPopulate(name, t.dialKeyspace(ks), opts)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			stats.requests += filled.requests
+			stats.errors += filled.errors
+			stats.bytes += filled.bytes
+			stats.elapsed += filled.elapsed
+		}
+		if *verbose {
+			fmt.Println(stats)
+		} else {
+			reportErrors(t, stats)
+		}
+		r.populated = stats
+	})
+}
+
+func printPopulations(results []*result) {
+	var populated bool
+	for _, r := range results {
+		populated = populated || r.populated != nil
+	}
+	if !populated {
+		return
+	}
+
+	fmt.Printf("%-16s %12s %12s %14s %14s %12s\n", "populate", "keys", "dataset", "keys/sec", "transfer/sec", "took")
+	for _, r := range results {
+		if r.populated == nil {
+			continue
+		}
+		p := r.populated
+		fmt.Printf("%-16s %12d %12s %14.2f %14s %12s\n", r.name, p.requests, formatBytes(float64(p.bytes)), p.throughput(), formatBytes(p.bytesThroughput()), p.elapsed-p.elapsed%time.Millisecond)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// pubsubDrainTimeout is how long subscribers may take to receive the
+// messages still in flight once publishing stops.
+const pubsubDrainTimeout = 5 * time.Second
+
+type pubsubStats struct {
+	published uint64
+	// expected sums the PUBLISH replies, the number of subscribers each
+	// message was delivered to.
+	expected  uint64
+	delivered uint64
+	// measured counts the deliveries of messages published after the
+	// warm-up, the ones whose latency was recorded.
+	measured uint64
+	// bytes counts the payload bytes of the measured deliveries.
+	bytes   uint64
+	elapsed time.Duration
+}
+
+func (s *pubsubStats) throughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.measured) / s.elapsed.Seconds()
+}
+
+func (s *pubsubStats) bytesThroughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.bytes) / s.elapsed.Seconds()
+}
+
+func (s *pubsubStats) String() string {
+	return fmt.Sprintf("%d messages published in %s, %d of %d deliveries received\nDelivered/sec:\t%.2f", s.published, s.elapsed, s.delivered, s.expected, s.throughput())
+}
+
+func pubsubChannel(index int) string {
+	return "tantrum:" + strconv.Itoa(index)
+}
+
+// runPubSub has --publishers connections publish to --channels channels round
+// robin while --subscribers connections each subscribe to one of them. Every
+// message carries the time it was meant to be sent so that subscribers can
+// record its end to end delivery latency, from the publisher's schedule
+// rather than from when it was actually written as the open loop does.
+func runPubSub(t target, opts loadOptions) (*pubsubStats, *histogram, error) {
+	latencies := newLatencyHistogram()
+	stats := &pubsubStats{}
+
+	// Every subscription is in place before the stage starts.
+	var subscriptions []redis.PubSubConn
+	defer func() {
+		for _, psc := range subscriptions {
+			psc.Close()
+		}
+	}()
+	for i := 0; i < int(*subscribers); i++ {
+		c, err := redis.Dial("tcp", t.address())
+		if err != nil {
+			return nil, nil, err
+		}
+		psc := redis.PubSubConn{Conn: c}
+		subscriptions = append(subscriptions, psc)
+		if err := psc.Subscribe(pubsubChannel(i % int(*channels))); err != nil {
+			return nil, nil, err
+		}
+		switch v := psc.Receive().(type) {
+		case error:
+			return nil, nil, v
+		case redis.Subscription:
+		default:
+			return nil, nil, fmt.Errorf("unexpected reply to SUBSCRIBE: %v", v)
+		}
+	}
+
+	var receiving, publishing sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+
+	s := newStage(opts)
+	for _, psc := range subscriptions {
+		receiving.Add(1)
+		go func(psc redis.PubSubConn) {
+			defer receiving.Done()
+			if err := pubsubSubscriber(s, psc, stats, latencies); err != nil {
+				setErr(err)
+			}
+		}(psc)
+	}
+
+	interval := time.Duration(0)
+	if *publishRate > 0 {
+		interval = time.Duration(float64(*publishers) / *publishRate * float64(time.Second))
+	}
+	for i := 0; i < int(*publishers); i++ {
+		c, err := redis.Dial("tcp", t.address())
+		if err != nil {
+			setErr(err)
+			break
+		}
+		publishing.Add(1)
+		go func(index int, c redis.Conn) {
+			defer publishing.Done()
+			defer c.Close()
+			g := newGenerator(s, opts.seed+int64(index))
+			if err := pubsubPublisher(s, c, index, interval, stats, g); err != nil {
+				setErr(err)
+			}
+		}(i, c)
+	}
+	publishing.Wait()
+	stats.elapsed = time.Since(s.measureStart)
+
+	// Wait for the messages in flight before unsubscribing.
+	drainDeadline := time.Now().Add(pubsubDrainTimeout)
+	for atomic.LoadUint64(&stats.delivered) < atomic.LoadUint64(&stats.expected) && time.Now().Before(drainDeadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, psc := range subscriptions {
+		psc.Unsubscribe()
+	}
+	receiving.Wait()
+
+	return stats, latencies, firstErr
+}
+
+// pubsubPublisher publishes to the channels round robin, as fast as replies
+// come back or on a fixed schedule when --publish-rate is set.
+func pubsubPublisher(s *stage, c redis.Conn, index int, interval time.Duration, stats *pubsubStats, g *generator) error {
+	for message := 0; ; message++ {
+		intended := time.Now()
+		if interval > 0 {
+			intended = s.start.Add(time.Duration(message) * interval)
+			if wait := intended.Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if !intended.Before(s.deadline) || s.take(1, s.warmingUp(intended)) == 0 {
+			return nil
+		}
+
+		payload := strconv.AppendInt(nil, intended.UnixNano(), 10)
+		payload = append(payload, ':')
+		payload = append(payload, g.value()...)
+		channel := pubsubChannel((index + message) % int(*channels))
+		receivers, err := redis.Uint64(c.Do("PUBLISH", channel, payload))
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&stats.published, 1)
+		atomic.AddUint64(&stats.expected, receivers)
+	}
+}
+
+// pubsubSubscriber records the delivery latency of every message published
+// after the warm-up until it is unsubscribed.
+func pubsubSubscriber(s *stage, psc redis.PubSubConn, stats *pubsubStats, latencies *histogram) error {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			now := time.Now()
+			atomic.AddUint64(&stats.delivered, 1)
+			sent, err := messageTimestamp(v.Data)
+			if err != nil {
+				return err
+			}
+			if sent.Before(s.measureStart) {
+				continue
+			}
+			latencies.recordLatency(now.Sub(sent))
+			atomic.AddUint64(&stats.measured, 1)
+			atomic.AddUint64(&stats.bytes, uint64(len(v.Data)))
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func messageTimestamp(data []byte) (time.Time, error) {
+	for i, b := range data {
+		if b == ':' {
+			nanos, err := strconv.ParseInt(string(data[:i]), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(0, nanos), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("message without a timestamp: %q", data)
+}
+
+func runPubSubBenchmark(t target, opts loadOptions, r *result) error {
+	if *verbose {
+		fmt.Printf("Running pub/sub benchmark for %s on %s\n\tPublishers:\t%d\n\tSubscribers:\t%d\n\tChannels:\t%d\n", t.name, t.address(), *publishers, *subscribers, *channels)
+	}
+
+	stats, latencies, err := runPubSub(t, opts)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Println(stats)
+		printLatencyDistribution(latencies)
+	} else if stats.delivered < stats.expected {
+		fmt.Printf("%s: %d of %d deliveries received\n", t.name, stats.delivered, stats.expected)
+	}
+	r.throughput = stats.throughput()
+	r.bytesThroughput = stats.bytesThroughput()
+	r.latency = latencies
+	return nil
+}
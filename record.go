@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorder writes the commands the proxy forwards to a trace in the format
+// replay reads.
+type recorder struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	encoder *json.Encoder
+	// start is when the first command was recorded, trace times count
+	// from it.
+	start time.Time
+	hash  bool
+	// skipped holds the commands left out of a hashed trace because their
+	// keys are unknown.
+	skipped map[string]bool
+}
+
+func (r *recorder) record(connection int64, args []string) {
+	// Credentials stay out of the trace, and so do the commands carrying
+	// them since a redacted one would fail on replay anyway.
+	if carriesCredentials(args) {
+		r.skip(strings.ToUpper(args[0]), fmt.Errorf("it carries credentials"))
+		return
+	}
+	line := traceLine{Connection: &connection, Command: args[0], Args: args[1:]}
+	if r.hash {
+		hashed, err := hashKeys(strings.ToUpper(args[0]), line.Args)
+		if err != nil {
+			r.skip(strings.ToUpper(args[0]), err)
+			return
+		}
+		line.Args = hashed
+	}
+
+	// Take the time under the lock so that no command is recorded before
+	// the start, times in a trace may never be negative.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.start.IsZero() {
+		r.start = now
+	}
+	at := now.Sub(r.start).Seconds()
+	line.Time = &at
+	if err := r.encoder.Encode(line); err != nil {
+		log.Fatalf("Error writing trace: %s", err)
+	}
+}
+
+// carriesCredentials tells whether a command carries a password: AUTH,
+// HELLO and MIGRATE with their AUTH options, CONFIG SET of requirepass or
+// masterauth and ACL SETUSER with password rules.
+func carriesCredentials(args []string) bool {
+	command := strings.ToUpper(args[0])
+	subcommand := ""
+	if len(args) > 1 {
+		subcommand = strings.ToUpper(args[1])
+	}
+	switch {
+	case command == "AUTH":
+		return true
+	case command == "HELLO" || command == "MIGRATE":
+		for _, arg := range args[1:] {
+			if strings.EqualFold(arg, "AUTH") || strings.EqualFold(arg, "AUTH2") {
+				return true
+			}
+		}
+	case command == "CONFIG" && subcommand == "SET":
+		for i := 2; i < len(args); i += 2 {
+			if strings.EqualFold(args[i], "requirepass") || strings.EqualFold(args[i], "masterauth") {
+				return true
+			}
+		}
+	case command == "ACL" && subcommand == "SETUSER":
+		for _, rule := range args[2:] {
+			if rule != "" && strings.ContainsRune("><#!", rune(rule[0])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skip reports a command left out of the trace the first time it is sent.
+func (r *recorder) skip(command string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.skipped[command] {
+		r.skipped[command] = true
+		fmt.Printf("Not recording %s: %s\n", command, err)
+	}
+}
+
+func (r *recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		log.Fatalf("Error writing trace: %s", err)
+	}
+}
+
+// runRecord listens as a RESP proxy in front of the target, forwarding every
+// client connection to a connection of its own to the target and recording
+// every command clients send until interrupted. Replies are passed back
+// untouched, so pub/sub and blocking commands work as they would directly.
+func runRecord(t target) {
+	f, err := os.Create(*tracePath)
+	if err != nil {
+		log.Fatalf("Error creating trace: %s", err)
+	}
+	w := bufio.NewWriter(f)
+	r := &recorder{w: w, encoder: json.NewEncoder(w), hash: *hashKeysFlag, skipped: make(map[string]bool)}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Error in Listen: %s", err)
+	}
+	fmt.Printf("Recording traffic to %s through %s into %s\n", t.address(), ln.Addr(), *tracePath)
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for range ticker.C {
+			r.flush()
+		}
+	}()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		r.flush()
+		f.Close()
+		fmt.Printf("Recorded into %s\n", *tracePath)
+		os.Exit(0)
+	}()
+
+	for connection := int64(1); ; connection++ {
+		client, err := ln.Accept()
+		if err != nil {
+			log.Fatalf("Error in Accept: %s", err)
+		}
+		go proxyConnection(t, client, connection, r)
+	}
+}
+
+func proxyConnection(t target, client net.Conn, connection int64, r *recorder) {
+	defer client.Close()
+	upstream, err := net.Dial("tcp", t.address())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer upstream.Close()
+
+	go func() {
+		io.Copy(client, upstream)
+		client.Close()
+	}()
+
+	reader := bufio.NewReader(client)
+	writer := bufio.NewWriter(upstream)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println(err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		r.record(connection, args)
+
+		writeCommand(writer, args)
+		// Flush once the client has no more pipelined commands buffered.
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+	}
+}
+
+// The largest command and argument readCommand accepts, the limits Redis
+// itself applies by default.
+const (
+	maxCommandArgs = 1024 * 1024
+	maxArgSize     = 512 * 1024 * 1024
+)
+
+// readCommand reads a command in either the RESP array form clients send or
+// the inline form of redis-cli and telnet.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxCommandArgs {
+		return nil, fmt.Errorf("invalid array header %q", line)
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		header, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("invalid bulk string header %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 || size > maxArgSize {
+			return nil, fmt.Errorf("invalid bulk string header %q", header)
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		args = append(args, string(bulk[:size]))
+	}
+	return args, nil
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeCommand(writer *bufio.Writer, args []string) {
+	fmt.Fprintf(writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// hashKeys replaces the keys among a command's arguments by a hash of them, so
+// a trace can be shared without its keys while every command still hits the
+// same keys on replay. Commands whose keys are unknown aren't hashed at all
+// rather than risk leaving a key in the clear.
+func hashKeys(command string, args []string) ([]string, error) {
+	indexes, ok := keyIndexes(command, len(args), func(i int) string { return args[i] })
+	if !ok {
+		return nil, fmt.Errorf("unknown keys, can't hash them")
+	}
+	if len(indexes) == 0 {
+		return args, nil
+	}
+	hashed := append([]string(nil), args...)
+	for _, i := range indexes {
+		hashed[i] = hashKey(hashed[i])
+	}
+	return hashed, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRecordLeavesOutCredentials(t *testing.T) {
+	tests := []struct {
+		args     []string
+		recorded bool
+	}{
+		{[]string{"AUTH", "secret"}, false},
+		{[]string{"auth", "user", "secret"}, false},
+		{[]string{"HELLO", "3"}, true},
+		{[]string{"HELLO", "3", "AUTH", "user", "secret"}, false},
+		{[]string{"hello", "2", "auth", "user", "secret", "SETNAME", "app"}, false},
+		{[]string{"MIGRATE", "host", "6379", "key", "0", "1000"}, true},
+		{[]string{"MIGRATE", "host", "6379", "key", "0", "1000", "AUTH", "secret"}, false},
+		{[]string{"MIGRATE", "host", "6379", "", "0", "1000", "AUTH2", "user", "secret", "KEYS", "a", "b"}, false},
+		{[]string{"CONFIG", "SET", "maxmemory", "1gb"}, true},
+		{[]string{"CONFIG", "SET", "requirepass", "secret"}, false},
+		{[]string{"config", "set", "maxmemory", "1gb", "MASTERAUTH", "secret"}, false},
+		{[]string{"CONFIG", "GET", "requirepass"}, true},
+		{[]string{"ACL", "SETUSER", "app", "on", "~*", "+@all"}, true},
+		{[]string{"ACL", "SETUSER", "app", "on", ">secret"}, false},
+		{[]string{"acl", "setuser", "app", "<secret"}, false},
+		{[]string{"ACL", "SETUSER", "app", "#5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"}, false},
+		{[]string{"ACL", "SETUSER", "app", "!5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"}, false},
+		{[]string{"SET", "key", "value"}, true},
+	}
+
+	for _, test := range tests {
+		var trace bytes.Buffer
+		w := bufio.NewWriter(&trace)
+		r := &recorder{w: w, encoder: json.NewEncoder(w), skipped: make(map[string]bool)}
+		r.record(1, test.args)
+		r.flush()
+
+		if recorded := trace.Len() > 0; recorded != test.recorded {
+			t.Errorf("%s: recorded %v, expected %v", strings.Join(test.args, " "), recorded, test.recorded)
+		}
+		if strings.Contains(trace.String(), "secret") {
+			t.Errorf("%s: credentials in the trace: %s", strings.Join(test.args, " "), trace.String())
+		}
+	}
+}
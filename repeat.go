@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+	"github.com/gonum/plot/vg/draw"
+)
+
+// summary describes the spread of a measurement across repeated trials.
+type summary struct {
+	count  int
+	mean   float64
+	median float64
+	stdDev float64
+	// ciLow and ciHigh bound the 95% confidence interval of the mean.
+	ciLow  float64
+	ciHigh float64
+}
+
+// tCritical95 holds the two-sided 95% critical values of Student's t
+// distribution for 1 to 30 degrees of freedom.
+var tCritical95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+func tCritical(degreesOfFreedom int) float64 {
+	if degreesOfFreedom < 1 {
+		return math.NaN()
+	}
+	if degreesOfFreedom <= len(tCritical95) {
+		return tCritical95[degreesOfFreedom-1]
+	}
+	return 1.960
+}
+
+func summarize(values []float64) summary {
+	s := summary{count: len(values)}
+	if s.count == 0 {
+		return s
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	if s.count%2 == 1 {
+		s.median = sorted[s.count/2]
+	} else {
+		s.median = (sorted[s.count/2-1] + sorted[s.count/2]) / 2
+	}
+
+	for _, value := range values {
+		s.mean += value
+	}
+	s.mean /= float64(s.count)
+
+	s.ciLow, s.ciHigh = s.mean, s.mean
+	if s.count < 2 {
+		return s
+	}
+
+	var squares float64
+	for _, value := range values {
+		squares += (value - s.mean) * (value - s.mean)
+	}
+	s.stdDev = math.Sqrt(squares / float64(s.count-1))
+
+	// Throughputs and latencies can't be negative, a wide interval over a
+	// few trials is cut off at 0 rather than reach below it.
+	margin := tCritical(s.count-1) * s.stdDev / math.Sqrt(float64(s.count))
+	s.ciLow, s.ciHigh = math.Max(0, s.mean-margin), s.mean+margin
+	return s
+}
+
+// scale returns the summary in another unit, factor units per original unit.
+func (s summary) scale(factor float64) summary {
+	s.mean *= factor
+	s.median *= factor
+	s.stdDev *= factor
+	s.ciLow *= factor
+	s.ciHigh *= factor
+	return s
+}
+
+func (s summary) String() string {
+	return fmt.Sprintf("%12.3f %12.3f %12.3f   [%.3f, %.3f]", s.mean, s.median, s.stdDev, s.ciLow, s.ciHigh)
+}
+
+// trialOrder returns the order targets are run in for every repetition,
+// shuffled per repetition so no target always runs first or right after
+// another.
+func trialOrder(targets int, repeat int, rng *rand.Rand) [][]int {
+	rounds := make([][]int, repeat)
+	for i := range rounds {
+		if repeat == 1 {
+			rounds[i] = make([]int, targets)
+			for j := range rounds[i] {
+				rounds[i][j] = j
+			}
+		} else {
+			rounds[i] = rng.Perm(targets)
+		}
+	}
+	return rounds
+}
+
+// runTrial runs the throughput stage and then the latency stage at the
+// throughput it measured, or the single stage of the other modes, recording
+// the outcome as a trial of r.
+func runTrial(t target, r *result) error {
+	trial := &result{name: t.name}
+
+	switch *mode {
+	case "pubsub":
+		if err := runPubSubBenchmark(t, stageOptions(), trial); err != nil {
+			return err
+		}
+		r.trials = append(r.trials, trial)
+		return nil
+	case "streams":
+		if err := runStreamsBenchmark(t, stageOptions(), trial); err != nil {
+			return err
+		}
+		r.trials = append(r.trials, trial)
+		return nil
+	case "transactions":
+		if err := runTransactionsBenchmark(t, stageOptions(), trial); err != nil {
+			return err
+		}
+		r.trials = append(r.trials, trial)
+		return nil
+	case "replay":
+		if err := runReplayBenchmark(t, stageOptions(), trial); err != nil {
+			return err
+		}
+		r.trials = append(r.trials, trial)
+		return nil
+	}
+
+	if err := runThroughputBenchmark(t, stageOptions(), trial); err != nil {
+		return err
+	}
+	if err := runLatencyBenchmark(t, stageOptions(), int(trial.throughput), trial); err != nil {
+		return err
+	}
+	r.trials = append(r.trials, trial)
+	return nil
+}
+
+// runTrials runs every target --repeat times, interleaving the targets in a
+// randomized order so that drift over the run doesn't favour any of them.
+func runTrials(targets []target, results []*result) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rounds := trialOrder(len(targets), int(*repeat), rng)
+
+	trial := func(round int, index int) {
+		t := targets[index]
+		if *repeat > 1 && *verbose {
+			fmt.Printf("Trial %d/%d for %s\n", round+1, len(rounds), t.name)
+		}
+		if err := runTrial(t, results[index]); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	for round, order := range rounds {
+		if *parallel {
+			// Every target gets its own generator and result, all running
+			// at once.
+			eachTarget(order, func(index int) { trial(round, index) })
+			if round < len(rounds)-1 && *sleep > 0 {
+				time.Sleep(time.Duration(*sleep) * time.Second)
+			}
+			continue
+		}
+
+		for position, index := range order {
+			trial(round, index)
+
+			last := round == len(rounds)-1 && position == len(order)-1
+			if !last && *sleep > 0 {
+				time.Sleep(time.Duration(*sleep) * time.Second)
+			}
+		}
+	}
+
+	for _, r := range results {
+		r.aggregateTrials()
+	}
+}
+
+// aggregateTrials sets the throughput to the mean across trials and merges
+// their latencies into single histograms.
+func (r *result) aggregateTrials() {
+	if len(r.trials) == 0 {
+		return
+	}
+	r.throughput = r.throughputSummary().mean
+	r.bytesThroughput = r.bytesThroughputSummary().mean
+	// Lag over time doesn't average meaningfully, the graph shows the
+	// first trial's.
+	r.lag = r.trials[0].lag
+	r.latency = newLatencyHistogram()
+	r.commandLatency = make(map[string]*histogram)
+	for _, trial := range r.trials {
+		r.latency.merge(trial.latency)
+		for name, latencies := range trial.commandLatency {
+			if _, ok := r.commandLatency[name]; !ok {
+				r.commandLatency[name] = newLatencyHistogram()
+			}
+			r.commandLatency[name].merge(latencies)
+		}
+	}
+}
+
+func (r *result) throughputSummary() summary {
+	values := make([]float64, len(r.trials))
+	for i, trial := range r.trials {
+		values[i] = trial.throughput
+	}
+	return summarize(values)
+}
+
+func (r *result) bytesThroughputSummary() summary {
+	values := make([]float64, len(r.trials))
+	for i, trial := range r.trials {
+		values[i] = trial.bytesThroughput
+	}
+	return summarize(values)
+}
+
+func (r *result) percentileSummary(percentile float64) summary {
+	values := make([]float64, len(r.trials))
+	for i, trial := range r.trials {
+		values[i] = milliseconds(trial.latency.valueAtPercentile(percentile))
+	}
+	return summarize(values)
+}
+
+func printTrialSummaries(results []*result) {
+	for _, r := range results {
+		if len(r.trials) < 2 {
+			continue
+		}
+		fmt.Printf("%s (%d trials)\n", r.name, len(r.trials))
+		fmt.Printf("%-16s %12s %12s %12s   %s\n", "", "mean", "median", "stddev", "95% CI")
+		fmt.Printf("%-16s %s\n", "requests/sec", r.throughputSummary())
+		fmt.Printf("%-16s %s\n", "MB/sec", r.bytesThroughputSummary().scale(1.0/(1024*1024)))
+		for _, percentile := range latencyPercentiles {
+			fmt.Printf("%-16s %s\n", fmt.Sprintf("p%g (ms)", percentile), r.percentileSummary(percentile))
+		}
+	}
+}
+
+// barErrorBar draws a confidence interval over a bar of a bar chart, which
+// positions its bars with an offset in points rather than in data space.
+type barErrorBar struct {
+	low, high float64
+	offset    vg.Length
+	draw.LineStyle
+	capWidth vg.Length
+}
+
+func newBarErrorBar(s summary, scale float64, offset vg.Length) *barErrorBar {
+	return &barErrorBar{
+		low:       s.ciLow * scale,
+		high:      s.ciHigh * scale,
+		offset:    offset,
+		LineStyle: plotter.DefaultLineStyle,
+		capWidth:  plotter.DefaultCapWidth,
+	}
+}
+
+func (e *barErrorBar) Plot(c draw.Canvas, p *plot.Plot) {
+	trX, trY := p.Transforms(&c)
+	x := trX(0) + e.offset
+	low, high := trY(e.low), trY(e.high)
+
+	c.StrokeLine2(e.LineStyle, x, low, x, high)
+	c.StrokeLine2(e.LineStyle, x-e.capWidth/2, low, x+e.capWidth/2, low)
+	c.StrokeLine2(e.LineStyle, x-e.capWidth/2, high, x+e.capWidth/2, high)
+}
+
+func (e *barErrorBar) DataRange() (xmin, xmax, ymin, ymax float64) {
+	return 0, 0, e.low, e.high
+}
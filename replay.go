@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// traceLine is one line of a JSONL command trace, such as
+//
+//	{"time": 0.0125, "connection": 3, "command": "SET", "args": ["key", "value"]}
+//
+// time is the optional offset in seconds from the start of the trace the
+// command was sent at and connection the optional id of the client
+// connection it was sent on. Either every line has a time or none does.
+type traceLine struct {
+	Time       *float64 `json:"time"`
+	Connection *int64   `json:"connection"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args,omitempty"`
+}
+
+type traceCommand struct {
+	name string
+	args []interface{}
+	at   time.Duration
+}
+
+// trace is a command trace split by the connection each command is replayed
+// on.
+type trace struct {
+	connections [][]traceCommand
+	commands    []string
+	timed       bool
+	count       int
+}
+
+// loadTrace reads and validates a JSONL trace. Commands keep the connections
+// they were recorded on, or are spread round robin across connections when
+// the trace doesn't say.
+func loadTrace(path string, connections int) (*trace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &trace{}
+	var connected bool
+	byID := make(map[int64]int)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 512*1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var line traceLine
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, number, err)
+		}
+		if line.Command == "" {
+			return nil, fmt.Errorf("%s:%d: missing command", path, number)
+		}
+		if t.count == 0 {
+			t.timed = line.Time != nil
+			connected = line.Connection != nil
+		} else if t.timed != (line.Time != nil) {
+			return nil, fmt.Errorf("%s:%d: time must be set on every line or none", path, number)
+		} else if connected != (line.Connection != nil) {
+			return nil, fmt.Errorf("%s:%d: connection must be set on every line or none", path, number)
+		}
+
+		command := traceCommand{name: strings.ToUpper(line.Command)}
+		for _, arg := range line.Args {
+			command.args = append(command.args, arg)
+		}
+		if line.Time != nil {
+			if *line.Time < 0 {
+				return nil, fmt.Errorf("%s:%d: negative time %g", path, number, *line.Time)
+			}
+			command.at = time.Duration(*line.Time * float64(time.Second))
+		}
+
+		index := t.count % connections
+		if line.Connection != nil {
+			var ok bool
+			if index, ok = byID[*line.Connection]; !ok {
+				index = len(byID)
+				byID[*line.Connection] = index
+			}
+		}
+		for len(t.connections) <= index {
+			t.connections = append(t.connections, nil)
+		}
+		t.connections[index] = append(t.connections[index], command)
+		if !seen[command.name] {
+			seen[command.name] = true
+			t.commands = append(t.commands, command.name)
+		}
+		t.count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if t.count == 0 {
+		return nil, fmt.Errorf("%s: empty trace", path)
+	}
+
+	// Commands are replayed in time order on each connection.
+	for _, commands := range t.connections {
+		sort.SliceStable(commands, func(i, j int) bool { return commands[i].at < commands[j].at })
+	}
+	return t, nil
+}
+
+var activeTrace *trace
+
+// replayed is a command in flight on a replay connection.
+type replayed struct {
+	intended time.Time
+	latency  *histogram
+	warmup   bool
+}
+
+// runReplay replays the trace against the target, every connection of the
+// trace on a connection of its own. As fast as possible it keeps up to
+// pipelined commands in flight per connection. Timed, with a positive
+// --speed, every command is sent at its offset in the trace divided by the
+// speed and its latency is measured from then, as the open loop does. The
+// whole trace is replayed unless --duration or --requests cut it short.
+func runReplay(dial dialFunc, opts loadOptions, tr *trace) (*loadStats, *recording, error) {
+	conns, err := dialConnections(dial, len(tr.connections))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeConnections(conns)
+
+	// Only a duration asked for cuts the trace short, not the default one.
+	if *duration == 0 && activeWorkload.duration == 0 {
+		opts.duration = 0
+	}
+	latencies := &recording{all: newLatencyHistogram(), byCommand: make(map[string]*histogram)}
+	for _, name := range tr.commands {
+		latencies.byCommand[name] = newLatencyHistogram()
+	}
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+
+	s := newStage(opts)
+	for index, c := range conns {
+		depth := openLoopQueueDepth
+		// As fast as possible, a command takes one of pipelined slots before
+		// it's sent and gives it back once its reply is received, which
+		// keeps no more than pipelined commands in flight.
+		var slots chan struct{}
+		if !tr.timed || *speed <= 0 {
+			depth = opts.pipelined
+			slots = make(chan struct{}, opts.pipelined)
+		}
+		queue := make(chan replayed, depth)
+
+		wg.Add(2)
+		go func(c conn, queue <-chan replayed, slots <-chan struct{}) {
+			defer wg.Done()
+			if err := replayReceiver(s, c, queue, slots, latencies.all); err != nil {
+				setErr(err)
+			}
+		}(c, queue, slots)
+		go func(c conn, commands []traceCommand, queue chan<- replayed, slots chan<- struct{}) {
+			defer wg.Done()
+			defer close(queue)
+			if err := replaySender(s, c, commands, queue, slots, tr.timed, latencies); err != nil {
+				setErr(err)
+			}
+		}(c, tr.connections[index], queue, slots)
+	}
+	wg.Wait()
+	s.finish()
+
+	return s.stats, latencies, firstErr
+}
+
+func replaySender(s *stage, c conn, commands []traceCommand, queue chan<- replayed, slots chan<- struct{}, timed bool, latencies *recording) error {
+	for _, command := range commands {
+		intended := time.Now()
+		if timed && *speed > 0 {
+			intended = s.start.Add(time.Duration(float64(command.at) / *speed))
+			if wait := intended.Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		warmup := s.warmingUp(intended)
+		if !intended.Before(s.deadline) || s.take(1, warmup) == 0 {
+			return nil
+		}
+
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		if err := c.Send(command.name, command.args...); err != nil {
+			return err
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		queue <- replayed{intended: intended, latency: latencies.byCommand[command.name], warmup: warmup}
+	}
+	return nil
+}
+
+func replayReceiver(s *stage, c conn, queue <-chan replayed, slots <-chan struct{}, all *histogram) error {
+	var failed error
+	for command := range queue {
+		if failed != nil {
+			// Keep draining so the sender never blocks on a dead connection.
+			if slots != nil {
+				<-slots
+			}
+			continue
+		}
+		var errors uint64
+		reply, err := c.Receive()
+		if slots != nil {
+			<-slots
+		}
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				failed = err
+				continue
+			}
+			errors = 1
+		}
+		if !command.warmup {
+			latency := time.Since(command.intended)
+			all.recordLatency(latency)
+			command.latency.recordLatency(latency)
+		}
+		s.stats.add(1, errors, replyBytes(reply), command.warmup)
+	}
+	return failed
+}
+
+func runReplayBenchmark(t target, opts loadOptions, r *result) error {
+	if *verbose {
+		fmt.Printf("Replaying %d commands on %d connections against %s on %s\n", activeTrace.count, len(activeTrace.connections), t.name, t.address())
+	}
+
+	stats, latencies, err := runReplay(t.dial, opts, activeTrace)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Println(stats)
+		printLatencyDistribution(latencies.all)
+	} else {
+		reportErrors(t, stats)
+	}
+	if stats.requests < uint64(activeTrace.count) && *duration == 0 && *requests == 0 && *warmup == 0 {
+		fmt.Printf("%s: replayed %d of %d commands\n", t.name, stats.requests, activeTrace.count)
+	}
+	r.throughput = stats.throughput()
+	r.bytesThroughput = stats.bytesThroughput()
+	r.latency = latencies.all
+	r.commandLatency = latencies.byCommand
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// scriptSpec is the "script" of a workload file. Keys and args are passed to
+// the script as they are except for $key, which is replaced by a key from the
+// key distribution, and $value, replaced by a value from the value sizes.
+//
+//	"script": {"file": "rate_limiter.lua", "keys": ["$key"], "args": ["100", "1"]}
+type scriptSpec struct {
+	File string   `json:"file"`
+	Keys []string `json:"keys"`
+	Args []string `json:"args"`
+}
+
+// workloadScript is a Lua script a workload runs with EVALSHA.
+type workloadScript struct {
+	source string
+	sha    string
+	keys   []string
+	args   []string
+}
+
+// loadScript reads the script of a workload file, resolving its path
+// relative to the file.
+func loadScript(workloadPath string, spec *scriptSpec) (*workloadScript, error) {
+	if spec.File == "" {
+		return nil, fmt.Errorf("script: missing file")
+	}
+	path := spec.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(workloadPath), path)
+	}
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("script: %s", err)
+	}
+
+	sum := sha1.Sum(source)
+	return &workloadScript{
+		source: string(source),
+		sha:    hex.EncodeToString(sum[:]),
+		keys:   spec.Keys,
+		args:   spec.Args,
+	}, nil
+}
+
+func (g *generator) scriptArg(template string) interface{} {
+	switch template {
+	case "$key":
+		return g.key()
+	case "$value":
+		return g.value()
+	}
+	return template
+}
+
+var scriptCommands = map[string]commandDefinition{
+	"EVALSHA": {dataType: "script", args: func(g *generator) []interface{} {
+		script := g.workload.script
+		args := []interface{}{script.sha, len(script.keys)}
+		for _, key := range script.keys {
+			args = append(args, g.scriptArg(key))
+		}
+		for _, arg := range script.args {
+			args = append(args, g.scriptArg(arg))
+		}
+		return args
+	}},
+}
+
+// loadScripts loads the active workload's script into the script cache of
+// every target so that EVALSHA finds it.
+func loadScripts(targets []target) error {
+	script := activeWorkload.script
+	if script == nil {
+		return nil
+	}
+
+	for _, t := range targets {
+		c, err := redis.Dial("tcp", t.address())
+		if err != nil {
+			return err
+		}
+		sha, err := redis.String(c.Do("SCRIPT", "LOAD", script.source))
+		c.Close()
+		if err != nil {
+			return fmt.Errorf("%s: SCRIPT LOAD: %s", t.name, err)
+		}
+		if sha != script.sha {
+			return fmt.Errorf("%s: SCRIPT LOAD returned %s, expected %s", t.name, sha, script.sha)
+		}
+	}
+	return nil
+}
+
+// scriptConn falls back to EVAL when EVALSHA fails with NOSCRIPT, because the
+// target lost its script cache to a SCRIPT FLUSH or a restart. The EVAL goes
+// over a connection of its own so that it doesn't reorder the replies still
+// pipelined on this one, and caches the script again for the EVALSHAs after
+// it.
+type scriptConn struct {
+	conn
+	script *workloadScript
+	dial   func() (conn, error)
+
+	// pending holds the arguments of every EVALSHA sent and not yet
+	// received, nil for other commands. The open loop sends and receives
+	// from different goroutines.
+	mu       sync.Mutex
+	pending  [][]interface{}
+	fallback conn
+}
+
+func (c *scriptConn) Send(commandName string, args ...interface{}) error {
+	c.mu.Lock()
+	if commandName == "EVALSHA" {
+		c.pending = append(c.pending, args)
+	} else {
+		c.pending = append(c.pending, nil)
+	}
+	c.mu.Unlock()
+	return c.conn.Send(commandName, args...)
+}
+
+func (c *scriptConn) Receive() (interface{}, error) {
+	reply, err := c.conn.Receive()
+	c.mu.Lock()
+	var args []interface{}
+	if len(c.pending) > 0 {
+		args, c.pending = c.pending[0], c.pending[1:]
+	}
+	c.mu.Unlock()
+
+	if e, ok := err.(redis.Error); !ok || args == nil || !strings.HasPrefix(string(e), "NOSCRIPT") {
+		return reply, err
+	}
+	if c.fallback == nil {
+		if c.fallback, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.fallback.Send("EVAL", append([]interface{}{c.script.source}, args[1:]...)...); err != nil {
+		return nil, err
+	}
+	if err := c.fallback.Flush(); err != nil {
+		return nil, err
+	}
+	return c.fallback.Receive()
+}
+
+func (c *scriptConn) Close() error {
+	if c.fallback != nil {
+		c.fallback.Close()
+	}
+	return c.conn.Close()
+}
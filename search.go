@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// sloEnabled reports whether a latency SLO was configured, in which case the
+// max sustainable throughput under it is searched for per target.
+func sloEnabled() bool {
+	return *sloLatency > 0
+}
+
+func sloDescription() string {
+	return fmt.Sprintf("p%g <= %s", *sloPercentile, *sloLatency)
+}
+
+// meetsSLO runs the latency stage at rate and reports whether the configured
+// percentile stayed within the threshold, along with the throughput achieved.
+func meetsSLO(t target, rate int) (bool, float64, error) {
+	stats, latencies, err := runOpenLoop(t.dial, stageOptions(), rate)
+	if err != nil {
+		return false, 0, err
+	}
+	latency := time.Duration(latencies.all.valueAtPercentile(*sloPercentile)) * time.Microsecond
+	if *verbose {
+		fmt.Printf("\t%d requests/sec achieved %.2f, p%g %s\n", rate, stats.throughput(), *sloPercentile, latency)
+	}
+	return latency <= *sloLatency, stats.throughput(), nil
+}
+
+// runSLOSearch bisects the constant rate between zero and the closed-loop max
+// throughput for the highest rate at which the SLO is still met, and records
+// the throughput achieved at that rate, which may fall short of it.
+func runSLOSearch(t target, r *result) error {
+	if *verbose {
+		fmt.Printf("Searching max sustainable throughput for %s with %s\n", t.name, sloDescription())
+	}
+	r.sloSearched = true
+
+	// The open loop needs a rate of at least one request per second.
+	high := int(r.throughput)
+	if high < 1 {
+		high = 1
+	}
+	ok, achieved, err := meetsSLO(t, high)
+	if err != nil {
+		return err
+	}
+	if ok {
+		r.sloThroughput = achieved
+		fmt.Printf("%s sustains its max, %.2f requests/sec with %s\n", t.name, achieved, sloDescription())
+		return nil
+	}
+
+	low, sustained := 0, 0.0
+	for i := 0; i < int(*sloIterations) && high-low > 1; i++ {
+		mid := (low + high) / 2
+		ok, achieved, err = meetsSLO(t, mid)
+		if err != nil {
+			return err
+		}
+		if ok {
+			low, sustained = mid, achieved
+		} else {
+			high = mid
+		}
+	}
+	r.sloThroughput = sustained
+
+	if low == 0 {
+		fmt.Printf("%s doesn't meet %s at any rate tried\n", t.name, sloDescription())
+		return nil
+	}
+	fmt.Printf("%s sustains %.2f requests/sec with %s\n", t.name, sustained, sloDescription())
+	return nil
+}
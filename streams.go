@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/plotutil"
+	"github.com/gonum/plot/vg"
+)
+
+const (
+	// streamGroup is the consumer group every consumer reads through.
+	streamGroup = "tantrum"
+	// streamReadCount and streamBlock bound a single XREADGROUP.
+	streamReadCount = 100
+	streamBlock     = 100 * time.Millisecond
+	// streamLagInterval is how often the consumer lag is sampled.
+	streamLagInterval = 500 * time.Millisecond
+	// streamDrainTimeout is how long consumers may take to catch up once
+	// producing stops.
+	streamDrainTimeout = 5 * time.Second
+)
+
+// lagSample is the number of entries appended but not yet acknowledged at
+// some point of a streams run.
+type lagSample struct {
+	at  time.Duration
+	lag uint64
+}
+
+type streamStats struct {
+	appended uint64
+	acked    uint64
+	// measuredAppends and measured count the entries appended and read
+	// after the warm-up, the ones whose latency was recorded.
+	measuredAppends uint64
+	measured        uint64
+	// appendLatencies holds how long XADD took and latencies the end to end
+	// latency from the intended append to the consumer reading the entry.
+	appendLatencies *histogram
+	latencies       *histogram
+	lag             []lagSample
+	// bytes counts the value bytes of the measured appends.
+	bytes   uint64
+	elapsed time.Duration
+}
+
+// throughput is the rate entries were appended at.
+func (s *streamStats) throughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.measuredAppends) / s.elapsed.Seconds()
+}
+
+func (s *streamStats) bytesThroughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.bytes) / s.elapsed.Seconds()
+}
+
+func (s *streamStats) maxLag() uint64 {
+	var max uint64
+	for _, sample := range s.lag {
+		if sample.lag > max {
+			max = sample.lag
+		}
+	}
+	return max
+}
+
+func (s *streamStats) String() string {
+	return fmt.Sprintf("%d entries appended in %s, %d acknowledged, max lag %d entries\nAppends/sec:\t%.2f", s.appended, s.elapsed, s.acked, s.maxLag(), s.throughput())
+}
+
+func streamKey(index int) string {
+	return "tantrum:stream:" + strconv.Itoa(index)
+}
+
+// runStreams has --producers connections XADD to --streams streams round robin
+// while --consumers connections read them through a consumer group with
+// XREADGROUP and acknowledge what they read with XACK. Entries carry the time
+// they were meant to be appended so consumers can record the end to end
+// latency. The streams are recreated before the run and deleted after it.
+func runStreams(t target, opts loadOptions) (*streamStats, error) {
+	admin, err := redis.Dial("tcp", t.address())
+	if err != nil {
+		return nil, err
+	}
+	defer admin.Close()
+	for i := 0; i < int(*streams); i++ {
+		if _, err := admin.Do("DEL", streamKey(i)); err != nil {
+			return nil, err
+		}
+		if _, err := admin.Do("XGROUP", "CREATE", streamKey(i), streamGroup, "$", "MKSTREAM"); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		for i := 0; i < int(*streams); i++ {
+			admin.Do("DEL", streamKey(i))
+		}
+	}()
+
+	stats := &streamStats{
+		appendLatencies: newLatencyHistogram(),
+		latencies:       newLatencyHistogram(),
+	}
+	var consuming, producing sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+	var stopping int32
+
+	s := newStage(opts)
+	for i := 0; i < int(*consumers); i++ {
+		c, err := redis.Dial("tcp", t.address())
+		if err != nil {
+			setErr(err)
+			break
+		}
+		consuming.Add(1)
+		go func(index int, c redis.Conn) {
+			defer consuming.Done()
+			defer c.Close()
+			if err := streamConsumer(s, c, index, stats, &stopping); err != nil {
+				setErr(err)
+			}
+		}(i, c)
+	}
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(streamLagInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				appended, acked := atomic.LoadUint64(&stats.appended), atomic.LoadUint64(&stats.acked)
+				var lag uint64
+				if appended > acked {
+					lag = appended - acked
+				}
+				stats.lag = append(stats.lag, lagSample{at: now.Sub(s.start), lag: lag})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	interval := time.Duration(0)
+	if *publishRate > 0 {
+		interval = time.Duration(float64(*producers) / *publishRate * float64(time.Second))
+	}
+	for i := 0; i < int(*producers); i++ {
+		c, err := redis.Dial("tcp", t.address())
+		if err != nil {
+			setErr(err)
+			break
+		}
+		producing.Add(1)
+		go func(index int, c redis.Conn) {
+			defer producing.Done()
+			defer c.Close()
+			g := newGenerator(s, opts.seed+int64(index))
+			if err := streamProducer(s, c, index, interval, stats, g); err != nil {
+				setErr(err)
+			}
+		}(i, c)
+	}
+	producing.Wait()
+	stats.elapsed = time.Since(s.measureStart)
+
+	drainDeadline := time.Now().Add(streamDrainTimeout)
+	for atomic.LoadUint64(&stats.acked) < atomic.LoadUint64(&stats.appended) && time.Now().Before(drainDeadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	atomic.StoreInt32(&stopping, 1)
+	consuming.Wait()
+	close(done)
+	<-sampled
+
+	return stats, firstErr
+}
+
+// streamProducer appends to the streams round robin, as fast as replies come
+// back or on a fixed schedule when --publish-rate is set.
+func streamProducer(s *stage, c redis.Conn, index int, interval time.Duration, stats *streamStats, g *generator) error {
+	for entry := 0; ; entry++ {
+		intended := time.Now()
+		if interval > 0 {
+			intended = s.start.Add(time.Duration(entry) * interval)
+			if wait := intended.Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		warmup := s.warmingUp(intended)
+		if !intended.Before(s.deadline) || s.take(1, warmup) == 0 {
+			return nil
+		}
+
+		stream := streamKey((index + entry) % int(*streams))
+		if _, err := c.Do("XADD", stream, "*", "sent", intended.UnixNano(), "value", g.value()); err != nil {
+			return err
+		}
+		atomic.AddUint64(&stats.appended, 1)
+		bytes := g.takeBytes()
+		if !warmup {
+			stats.appendLatencies.recordLatency(time.Since(intended))
+			atomic.AddUint64(&stats.measuredAppends, 1)
+			atomic.AddUint64(&stats.bytes, bytes)
+		}
+	}
+}
+
+// streamConsumer reads its stream through the consumer group, recording the
+// latency of every entry appended after the warm-up and acknowledging each
+// batch it reads, until stopping is set.
+func streamConsumer(s *stage, c redis.Conn, index int, stats *streamStats, stopping *int32) error {
+	stream := streamKey(index % int(*streams))
+	consumer := "consumer:" + strconv.Itoa(index)
+
+	for atomic.LoadInt32(stopping) == 0 {
+		reply, err := redis.Values(c.Do("XREADGROUP", "GROUP", streamGroup, consumer, "COUNT", streamReadCount, "BLOCK", int64(streamBlock/time.Millisecond), "STREAMS", stream, ">"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+
+		ack := []interface{}{stream, streamGroup}
+		for _, streamReply := range reply {
+			streamEntries, err := redis.Values(streamReply, nil)
+			if err != nil || len(streamEntries) != 2 {
+				return fmt.Errorf("unexpected XREADGROUP reply: %v", reply)
+			}
+			entries, err := redis.Values(streamEntries[1], nil)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				id, sent, err := parseStreamEntry(entry)
+				if err != nil {
+					return err
+				}
+				ack = append(ack, id)
+				if !sent.Before(s.measureStart) {
+					stats.latencies.recordLatency(now.Sub(sent))
+					atomic.AddUint64(&stats.measured, 1)
+				}
+			}
+		}
+		if len(ack) == 2 {
+			continue
+		}
+		if _, err := c.Do("XACK", ack...); err != nil {
+			return err
+		}
+		atomic.AddUint64(&stats.acked, uint64(len(ack)-2))
+	}
+	return nil
+}
+
+// parseStreamEntry returns the id of an entry and the time it was meant to be
+// appended.
+func parseStreamEntry(entry interface{}) (string, time.Time, error) {
+	parts, err := redis.Values(entry, nil)
+	if err != nil || len(parts) != 2 {
+		return "", time.Time{}, fmt.Errorf("unexpected stream entry: %v", entry)
+	}
+	id, err := redis.String(parts[0], nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	fields, err := redis.StringMap(parts[1], nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(fields["sent"], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("stream entry %s without a send time", id)
+	}
+	return id, time.Unix(0, nanos), nil
+}
+
+func runStreamsBenchmark(t target, opts loadOptions, r *result) error {
+	if *verbose {
+		fmt.Printf("Running streams benchmark for %s on %s\n\tProducers:\t%d\n\tConsumers:\t%d\n\tStreams:\t%d\n", t.name, t.address(), *producers, *consumers, *streams)
+	}
+
+	stats, err := runStreams(t, opts)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Println(stats)
+		fmt.Println("Append latency")
+		printLatencyDistribution(stats.appendLatencies)
+		fmt.Println("End to end latency")
+		printLatencyDistribution(stats.latencies)
+	} else if stats.acked < stats.appended {
+		fmt.Printf("%s: %d of %d entries acknowledged\n", t.name, stats.acked, stats.appended)
+	}
+	r.throughput = stats.throughput()
+	r.bytesThroughput = stats.bytesThroughput()
+	r.latency = stats.latencies
+	r.lag = stats.lag
+	return nil
+}
+
+// generateLagGraph plots the consumer lag of every target over the course of
+// its streams run.
+func generateLagGraph(results []*result) {
+	p, err := plot.New()
+	if err != nil {
+		panic(err)
+	}
+	p.Title.Text = "consumer lag"
+	p.BackgroundColor = color.White
+	p.Legend.Top = true
+	p.Legend.Left = true
+
+	p.X.Label.Text = "seconds"
+	p.Y.Label.Text = "entries appended but not acknowledged"
+
+	p.Add(plotter.NewGrid())
+
+	for index, r := range results {
+		if len(r.lag) == 0 {
+			continue
+		}
+		points := make(plotter.XYs, len(r.lag))
+		for i, sample := range r.lag {
+			points[i].X = sample.at.Seconds()
+			points[i].Y = float64(sample.lag)
+		}
+
+		var line *plotter.Line
+		line, err = plotter.NewLine(points)
+		if err != nil {
+			panic(err)
+		}
+		line.Color = plotutil.Color(index)
+
+		p.Add(line)
+		p.Legend.Add(r.label(), line)
+	}
+
+	if err = p.Save(8*vg.Inch, 4*vg.Inch, "results_lag.png"); err != nil {
+		panic(err)
+	}
+}
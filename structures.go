@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+)
+
+// workloadTemplates are the built-in command mixes for each data structure,
+// selected with --template or "template" in a workload file.
+var workloadTemplates = map[string]string{
+	"hash": "HSET:20,HGETALL:80",
+	"list": "LPUSH:20,LRANGE:80",
+	"set":  "SADD:20,SISMEMBER:80",
+	"zset": "ZADD:20,ZRANGEBYSCORE:80",
+}
+
+// Keys of each data structure are prefixed with its type so that workloads
+// mixing types never hit a key holding another type. Collections hold up to
+// the workload's collection size elements, picked by index so that writes
+// overwrite rather than grow them. Lists can't be written by index, so every
+// LPUSH is followed by an LTRIM down to the collection size. Reads fetch the
+// whole collection.
+
+func (g *generator) collectionKey(dataType string) string {
+	return dataType + ":" + keyName(g.nextKey())
+}
+
+// element picks the index of an element of a collection.
+func (g *generator) element() int {
+	return g.rng.Intn(g.workload.collectionSize)
+}
+
+func fieldName(element int) string {
+	return "field:" + strconv.Itoa(element)
+}
+
+// member returns the set or sorted set member at element. Its size comes
+// from the value sizes but is fixed per element so that a member is always
+// the same bytes.
+func (g *generator) member(element int) []byte {
+	value := g.workload.values.valueAt(uint64(element))
+	member := make([]byte, 0, 11+len(value))
+	member = strconv.AppendInt(member, int64(element), 10)
+	member = append(member, ':')
+	return append(member, value...)
+}
+
+// writeMember returns the member at element for a command that writes it,
+// counting its bytes as written.
+func (g *generator) writeMember(element int) []byte {
+	member := g.member(element)
+	g.bytes += uint64(len(member))
+	return member
+}
+
+var structureCommands = map[string]commandDefinition{
+	"HSET": {dataType: "hash", args: func(g *generator) []interface{} {
+		return []interface{}{g.collectionKey("hash"), fieldName(g.element()), g.value()}
+	}},
+	"HGETALL": {dataType: "hash", args: func(g *generator) []interface{} {
+		return []interface{}{g.collectionKey("hash")}
+	}},
+	"LPUSH": {dataType: "list", args: func(g *generator) []interface{} {
+		return []interface{}{g.collectionKey("list"), g.value()}
+	}, followUp: func(g *generator, args []interface{}) (string, []interface{}) {
+		return "LTRIM", []interface{}{args[0], 0, g.workload.collectionSize - 1}
+	}},
+	"LRANGE": {dataType: "list", args: func(g *generator) []interface{} {
+		return []interface{}{g.collectionKey("list"), 0, g.workload.collectionSize - 1}
+	}},
+	"SADD": {dataType: "set", args: func(g *generator) []interface{} {
+		return []interface{}{g.collectionKey("set"), g.writeMember(g.element())}
+	}},
+	"SISMEMBER": {dataType: "set", args: func(g *generator) []interface{} {
+		return []interface{}{g.collectionKey("set"), g.member(g.element())}
+	}},
+	"ZADD": {dataType: "zset", args: func(g *generator) []interface{} {
+		element := g.element()
+		return []interface{}{g.collectionKey("zset"), element, g.writeMember(element)}
+	}},
+	"ZRANGEBYSCORE": {dataType: "zset", args: func(g *generator) []interface{} {
+		return []interface{}{g.collectionKey("zset"), "-inf", "+inf"}
+	}},
+}
+
+// fillCommand returns the command the populate stage writes the key at index
+// of dataType with, filling a collection in one variadic command.
+func (g *generator) fillCommand(dataType string, index int64) (string, []interface{}) {
+	key := dataType + ":" + keyName(index)
+	size := g.workload.collectionSize
+
+	switch dataType {
+	case "hash":
+		args := []interface{}{key}
+		for element := 0; element < size; element++ {
+			args = append(args, fieldName(element), g.value())
+		}
+		return "HSET", args
+	case "list":
+		args := []interface{}{key}
+		for element := 0; element < size; element++ {
+			args = append(args, g.value())
+		}
+		return "LPUSH", args
+	case "set":
+		args := []interface{}{key}
+		for element := 0; element < size; element++ {
+			args = append(args, g.writeMember(element))
+		}
+		return "SADD", args
+	case "zset":
+		args := []interface{}{key}
+		for element := 0; element < size; element++ {
+			args = append(args, element, g.writeMember(element))
+		}
+		return "ZADD", args
+	}
+	return "SET", []interface{}{keyName(index), g.value()}
+}
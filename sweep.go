@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/plotutil"
+	"github.com/gonum/plot/vg"
+)
+
+// sweepRate is one point of a --sweep, either a fraction of the measured max
+// throughput or an absolute rate in requests/sec.
+type sweepRate struct {
+	fraction float64
+	absolute int
+}
+
+// sweepPoint is the outcome of running the latency stage at one sweep rate.
+type sweepPoint struct {
+	rate       int
+	throughput float64
+	latency    *histogram
+}
+
+var sweepRates []sweepRate
+
+// sweepPercentiles are plotted against achieved throughput on the sweep graph.
+var sweepPercentiles = []float64{50, 99, 99.9}
+
+func parseSweepRates(spec string) ([]sweepRate, error) {
+	var rates []sweepRate
+	if spec == "" {
+		return rates, nil
+	}
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if strings.HasSuffix(field, "%") {
+			percentage, err := strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+			if err != nil || percentage <= 0 {
+				return nil, fmt.Errorf("invalid percentage %q", field)
+			}
+			rates = append(rates, sweepRate{fraction: percentage / 100})
+		} else {
+			rate, err := strconv.Atoi(field)
+			if err != nil || rate <= 0 {
+				return nil, fmt.Errorf("invalid rate %q", field)
+			}
+			rates = append(rates, sweepRate{absolute: rate})
+		}
+	}
+	return rates, nil
+}
+
+// resolve returns the rate in requests/sec, at least one since the open loop
+// can't run slower even when a fraction of a low max throughput rounds down
+// to nothing.
+func (s sweepRate) resolve(maxThroughput float64) int {
+	if s.absolute > 0 {
+		return s.absolute
+	}
+	rate := int(maxThroughput * s.fraction)
+	if rate < 1 {
+		rate = 1
+	}
+	return rate
+}
+
+// runSweep runs the latency stage once per sweep rate, recording the
+// throughput the target actually achieved at each.
+func runSweep(t target, r *result) error {
+	for _, sweepRate := range sweepRates {
+		rate := sweepRate.resolve(r.throughput)
+		if *verbose {
+			fmt.Printf("Sweeping %s at %d requests/sec\n", t.name, rate)
+		}
+
+		stats, latencies, err := runOpenLoop(t.dial, stageOptions(), rate)
+		if err != nil {
+			return err
+		}
+		if *verbose {
+			fmt.Println(stats)
+			printLatencyDistribution(latencies.all)
+		}
+		r.sweep = append(r.sweep, sweepPoint{
+			rate:       rate,
+			throughput: stats.throughput(),
+			latency:    latencies.all,
+		})
+	}
+	sort.Sort(sweepPointsByRate(r.sweep))
+	return nil
+}
+
+type sweepPointsByRate []sweepPoint
+
+func (s sweepPointsByRate) Len() int           { return len(s) }
+func (s sweepPointsByRate) Less(i, j int) bool { return s[i].rate < s[j].rate }
+func (s sweepPointsByRate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func generateSweepGraph(results []*result) {
+	p, err := plot.New()
+	if err != nil {
+		panic(err)
+	}
+	p.Title.Text = "latency vs throughput"
+	p.BackgroundColor = color.White
+	p.Legend.Top = true
+	p.Legend.Left = true
+
+	p.X.Label.Text = "achieved operations/second (thousands)"
+	p.Y.Label.Text = "latency (milliseconds)"
+
+	p.Add(plotter.NewGrid())
+
+	for index, r := range results {
+		if len(r.sweep) == 0 {
+			continue
+		}
+
+		for percentileIndex, percentile := range sweepPercentiles {
+			points := make(plotter.XYs, len(r.sweep))
+			for i, point := range r.sweep {
+				points[i].X = point.throughput / 1000
+				points[i].Y = milliseconds(point.latency.valueAtPercentile(percentile))
+			}
+
+			var lpLine *plotter.Line
+			var lpPoints *plotter.Scatter
+			lpLine, lpPoints, err = plotter.NewLinePoints(points)
+			if err != nil {
+				panic(err)
+			}
+			lpLine.Color = plotutil.Color(index)
+			lpLine.Dashes = plotutil.Dashes(percentileIndex)
+			lpPoints.Color = plotutil.Color(index)
+			lpPoints.Shape = plotutil.Shape(percentileIndex)
+
+			p.Add(lpLine, lpPoints)
+			p.Legend.Add(fmt.Sprintf("%s p%g", r.label(), percentile), lpLine, lpPoints)
+		}
+	}
+
+	if err = p.Save(8*vg.Inch, 4*vg.Inch, "results_sweep.png"); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// target is one entry of --hosts, either name:host:port or host:port.
+type target struct {
+	name     string
+	host     string
+	port     int
+	httpPort int
+}
+
+func parseTargets() []target {
+	var targets []target
+	httpPort := httpBasePort
+
+	for _, address := range strings.Split(*hosts, ",") {
+		var offset = 0
+		var name string
+		httpPort++
+
+		hostParts := strings.Split(address, ":")
+		if len(hostParts) > 2 {
+			offset = 1
+			name = hostParts[0]
+		} else {
+			name = hostParts[0] + " " + hostParts[1]
+		}
+		port, _ := strconv.ParseInt(hostParts[1+offset], 10, 32)
+
+		targets = append(targets, target{
+			name:     name,
+			host:     hostParts[0+offset],
+			port:     int(port),
+			httpPort: httpPort,
+		})
+	}
+	return targets
+}
+
+func (t target) address() string {
+	return fmt.Sprintf("%s:%d", t.host, t.port)
+}
+
+// dial connects the load generator to the target. The connections of a stage
+// are spread across the active workload's keyspaces round robin by their
+// index, so every stage lays them out the same way.
+func (t target) dial(index int) (conn, error) {
+	keyspaces := activeWorkload.keyspaces
+	return t.dialKeyspace(keyspaces[index%len(keyspaces)])(index)
+}
+
+// dialKeyspace returns a dialFunc for connections to the target in keyspace
+// ks. In RESP mode they talk to Redis directly, in HTTP mode they go through
+// the target's HTTP shim.
+func (t target) dialKeyspace(ks keyspace) dialFunc {
+	return func(index int) (conn, error) {
+		if *protocol == "http" {
+			return dialHTTP(fmt.Sprintf("localhost:%d", t.httpPort), ks)
+		}
+		c, err := t.dialRedis(ks)
+		if err != nil {
+			return nil, err
+		}
+		if activeWorkload.script != nil {
+			return &scriptConn{conn: c, script: activeWorkload.script, dial: func() (conn, error) { return t.dialRedis(ks) }}, nil
+		}
+		return c, nil
+	}
+}
+
+func (t target) dialRedis(ks keyspace) (conn, error) {
+	c, err := redis.Dial("tcp", t.address(), redis.DialDatabase(ks.database))
+	if err != nil {
+		return nil, err
+	}
+	if ks != (keyspace{}) || len(activeWorkload.keyspaces) > 1 {
+		return &keyspaceConn{conn: c, prefix: ks.prefix}, nil
+	}
+	return c, nil
+}
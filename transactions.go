@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type transactionStats struct {
+	// attempts counts every WATCH/MULTI/EXEC round, committed those whose
+	// EXEC went through and aborts those whose EXEC a concurrent write to
+	// the watched key aborted.
+	attempts  uint64
+	committed uint64
+	aborts    uint64
+	// failed counts transactions that gave up after --tx-retries aborts.
+	failed  uint64
+	errors  uint64
+	elapsed time.Duration
+}
+
+func (s *transactionStats) throughput() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.committed) / s.elapsed.Seconds()
+}
+
+func (s *transactionStats) abortRate() float64 {
+	if s.attempts == 0 {
+		return 0
+	}
+	return float64(s.aborts) / float64(s.attempts)
+}
+
+func (s *transactionStats) String() string {
+	return fmt.Sprintf("%d transactions committed in %s, %d attempts, %d aborts (%.2f%%), %d failed, %d errors\nTransactions/sec:\t%.2f", s.committed, s.elapsed, s.attempts, s.aborts, 100*s.abortRate(), s.failed, s.errors, s.throughput())
+}
+
+func transactionKey(index int64) string {
+	return "tx:" + keyName(index)
+}
+
+// runTransactions has every connection increment counters with an optimistic
+// read-modify-write, WATCH and GET the counter then MULTI, SET and EXEC its
+// new value, retrying when EXEC aborts because another connection wrote the
+// counter in between. The key distribution picks the counters so it controls
+// the contention. Latency runs from the first WATCH to the EXEC that commits,
+// retries included. Only the stats of transactions started after the warm-up
+// are kept.
+func runTransactions(dial dialFunc, opts loadOptions) (*transactionStats, *histogram, error) {
+	conns, err := dialConnections(dial, opts.connections)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeConnections(conns)
+
+	stats := &transactionStats{}
+	latencies := newLatencyHistogram()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	s := newStage(opts)
+	for index, c := range conns {
+		wg.Add(1)
+		go func(seed int64, c conn) {
+			defer wg.Done()
+			g := newGenerator(s, seed)
+			if err := transactionWorker(s, c, stats, latencies, g); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(opts.seed+int64(index), c)
+	}
+	wg.Wait()
+	stats.elapsed = time.Since(s.measureStart)
+
+	return stats, latencies, firstErr
+}
+
+func transactionWorker(s *stage, c conn, stats *transactionStats, latencies *histogram, g *generator) error {
+	for {
+		start := time.Now()
+		if !start.Before(s.deadline) {
+			return nil
+		}
+		warmup := s.warmingUp(start)
+		if s.take(1, warmup) == 0 {
+			return nil
+		}
+
+		key := transactionKey(g.nextKey())
+		var attempts, aborts, errors uint64
+		committed := false
+		for !committed && attempts <= uint64(*txRetries) {
+			attempts++
+			var err error
+			committed, err = incrementTransaction(c, key)
+			if _, ok := err.(redis.Error); ok {
+				errors++
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !committed {
+				aborts++
+			}
+		}
+
+		if warmup {
+			continue
+		}
+		atomic.AddUint64(&stats.attempts, attempts)
+		atomic.AddUint64(&stats.aborts, aborts)
+		atomic.AddUint64(&stats.errors, errors)
+		switch {
+		case committed:
+			atomic.AddUint64(&stats.committed, 1)
+			latencies.recordLatency(time.Since(start))
+		case errors == 0:
+			atomic.AddUint64(&stats.failed, 1)
+		}
+	}
+}
+
+// incrementTransaction runs one optimistic increment of the counter at key
+// and reports whether it committed. WATCH and GET go out pipelined, and so do
+// MULTI, SET and EXEC.
+func incrementTransaction(c conn, key string) (bool, error) {
+	c.Send("WATCH", key)
+	c.Send("GET", key)
+	reply, err := receiveReplies(c, 2)
+	if err != nil {
+		if _, ok := err.(redis.Error); ok {
+			c.Send("UNWATCH")
+			receiveReplies(c, 1)
+		}
+		return false, err
+	}
+	// A missing or non numeric value counts from 0.
+	counter, _ := redis.Int64(reply, nil)
+
+	c.Send("MULTI")
+	c.Send("SET", key, strconv.FormatInt(counter+1, 10))
+	c.Send("EXEC")
+	reply, err = receiveReplies(c, 3)
+	if err != nil {
+		return false, err
+	}
+	// EXEC replies with a nil array when the watched key changed.
+	return reply != nil, nil
+}
+
+// receiveReplies flushes the commands sent and reads their n replies, so that
+// an error reply never leaves any behind, returning the last reply and the
+// first error.
+func receiveReplies(c conn, n int) (interface{}, error) {
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	var firstErr error
+	for i := 0; i < n; i++ {
+		var err error
+		reply, err = c.Receive()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return reply, firstErr
+}
+
+func runTransactionsBenchmark(t target, opts loadOptions, r *result) error {
+	if *verbose {
+		fmt.Printf("Running transactions benchmark for %s on %s\n\tConnections:\t%d\n", t.name, t.address(), opts.connections)
+	}
+
+	stats, latencies, err := runTransactions(t.dial, opts)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Println(stats)
+		printLatencyDistribution(latencies)
+	} else {
+		fmt.Printf("%s: %.2f%% of %d attempts aborted, %d transactions failed, %d errors\n", t.name, 100*stats.abortRate(), stats.attempts, stats.failed, stats.errors)
+	}
+	r.throughput = stats.throughput()
+	r.latency = latencies
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// valueSizes decides how large the values a workload writes are, either a
+// fixed size, a uniform range or a weighted histogram of sizes.
+type valueSizes struct {
+	// sizes and weights hold the histogram, a fixed size is a histogram
+	// of one.
+	sizes       []int
+	weights     []int
+	totalWeight int
+	// low and high bound a uniform range when sizes is empty.
+	low, high int
+	// data backs every value, values are slices of it at an offset picked
+	// per value so writing them allocates nothing while values of the same
+	// size still differ.
+	data []byte
+}
+
+// valueOffsets is how many offsets into the data values start at, and so how
+// many distinct values of each size there are.
+const valueOffsets = 1 << 20
+
+// valueAlphabet makes up the data, random so that it neither compresses nor
+// deduplicates better than real data would.
+const valueAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// parseValueSizes parses a value size spec, a fixed size such as 100, a
+// uniform range such as 100-4KB or a weighted histogram such as
+// 100:70,4KB:25,256KB:5.
+func parseValueSizes(spec string) (*valueSizes, error) {
+	v := &valueSizes{}
+	switch {
+	case strings.Contains(spec, ":"):
+		for _, field := range strings.Split(spec, ",") {
+			parts := strings.Split(strings.TrimSpace(field), ":")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid value size %q, expected SIZE:WEIGHT", field)
+			}
+			size, err := parseByteSize(parts[0])
+			if err != nil {
+				return nil, err
+			}
+			weight, err := strconv.Atoi(parts[1])
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid weight %q for size %s", parts[1], parts[0])
+			}
+			v.sizes = append(v.sizes, size)
+			v.weights = append(v.weights, weight)
+			v.totalWeight += weight
+		}
+	case strings.Contains(spec, "-"):
+		parts := strings.Split(spec, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid value size range %q, expected LOW-HIGH", spec)
+		}
+		var err error
+		if v.low, err = parseByteSize(parts[0]); err != nil {
+			return nil, err
+		}
+		if v.high, err = parseByteSize(parts[1]); err != nil {
+			return nil, err
+		}
+		if v.low > v.high {
+			return nil, fmt.Errorf("invalid value size range %q, low is above high", spec)
+		}
+	default:
+		size, err := parseByteSize(spec)
+		if err != nil {
+			return nil, err
+		}
+		v.sizes = []int{size}
+		v.weights = []int{1}
+		v.totalWeight = 1
+	}
+
+	v.data = make([]byte, v.max()+valueOffsets)
+	rng := rand.New(rand.NewSource(1))
+	for i := range v.data {
+		v.data[i] = valueAlphabet[rng.Intn(len(valueAlphabet))]
+	}
+	return v, nil
+}
+
+// parseByteSize parses a size in bytes with an optional B, KB or MB suffix.
+func parseByteSize(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "KB"):
+		multiplier, s = 1024, strings.TrimSuffix(s, "KB")
+	case strings.HasSuffix(s, "MB"):
+		multiplier, s = 1024*1024, strings.TrimSuffix(s, "MB")
+	case strings.HasSuffix(s, "B"):
+		s = strings.TrimSuffix(s, "B")
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size * multiplier, nil
+}
+
+func (v *valueSizes) max() int {
+	if len(v.sizes) == 0 {
+		return v.high
+	}
+	max := 0
+	for _, size := range v.sizes {
+		if size > max {
+			max = size
+		}
+	}
+	return max
+}
+
+// value picks the size of the next value and returns a value of that size.
+func (v *valueSizes) value(rng *rand.Rand) []byte {
+	offset := rng.Intn(valueOffsets)
+	if len(v.sizes) == 0 {
+		return v.data[offset : offset+v.low+rng.Intn(v.high-v.low+1)]
+	}
+	if len(v.sizes) == 1 {
+		return v.data[offset : offset+v.sizes[0]]
+	}
+	pick := rng.Intn(v.totalWeight)
+	for i, weight := range v.weights {
+		if pick < weight {
+			return v.data[offset : offset+v.sizes[i]]
+		}
+		pick -= weight
+	}
+	panic("unreachable")
+}
+
+// valueAt returns a value whose size is picked by n rather than at random, so
+// the same n always gets the same value.
+func (v *valueSizes) valueAt(n uint64) []byte {
+	// Mix n so that neighbouring elements don't get neighbouring sizes.
+	n ^= n >> 33
+	n *= 0xff51afd7ed558ccd
+	n ^= n >> 33
+	offset := int(n>>32) % valueOffsets
+	if len(v.sizes) == 0 {
+		return v.data[offset : offset+v.low+int(n%uint64(v.high-v.low+1))]
+	}
+	pick := int(n % uint64(v.totalWeight))
+	for i, weight := range v.weights {
+		if pick < weight {
+			return v.data[offset : offset+v.sizes[i]]
+		}
+		pick -= weight
+	}
+	panic("unreachable")
+}
+
+// replyBytes counts the payload bytes of a reply, the bulk strings in it.
+func replyBytes(reply interface{}) uint64 {
+	switch reply := reply.(type) {
+	case []byte:
+		return uint64(len(reply))
+	case []interface{}:
+		var n uint64
+		for _, element := range reply {
+			n += replyBytes(element)
+		}
+		return n
+	}
+	return 0
+}
+
+// formatBytes formats a byte count with a binary unit the way wrk does.
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	unit := 0
+	for n >= 1024 && unit < len(units)-1 {
+		n /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%s", n, units[unit])
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workloadPhases are the workloads benchmarked one after another, and
+// activeWorkload the one currently running.
+var (
+	workloadPhases []*workload
+	activeWorkload *workload
+)
+
+// workload describes the commands a stage issues and how often each of them
+// is picked relative to the others.
+type workload struct {
+	// name names the phase of a workload file the workload came from.
+	name        string
+	commands    []workloadCommand
+	totalWeight int
+	keys        keyDistribution
+	values      *valueSizes
+	seed        int64
+	// duration and requests bound the stages of the phase in place of
+	// --duration and --requests when set.
+	duration time.Duration
+	requests uint64
+	// populate fills the keyspace before the phase's stages run.
+	populate bool
+	// collectionSize is the number of elements in each hash, list, set
+	// and sorted set.
+	collectionSize int
+	// script is the script EVALSHA runs.
+	script *workloadScript
+	// keyspaces are the databases and key prefixes the connections are
+	// spread across.
+	keyspaces []keyspace
+}
+
+type workloadCommand struct {
+	name     string
+	weight   int
+	dataType string
+	args     func(g *generator) []interface{}
+	followUp followUpFunc
+}
+
+// commandDefinition describes a command a workload may mix, the type of the
+// keys it works on and how to build its arguments.
+type commandDefinition struct {
+	dataType string
+	args     func(g *generator) []interface{}
+	// followUp builds a command sent right after this one on the same
+	// connection. Its reply is taken as part of the command's.
+	followUp followUpFunc
+}
+
+type followUpFunc func(g *generator, args []interface{}) (string, []interface{})
+
+var stringCommands = map[string]commandDefinition{
+	"GET": {dataType: "string", args: func(g *generator) []interface{} {
+		return []interface{}{g.key()}
+	}},
+	"SET": {dataType: "string", args: func(g *generator) []interface{} {
+		return []interface{}{g.key(), g.value()}
+	}},
+	"DEL": {dataType: "string", args: func(g *generator) []interface{} {
+		return []interface{}{g.key()}
+	}},
+}
+
+func lookupCommand(name string) (commandDefinition, bool) {
+	if definition, ok := stringCommands[name]; ok {
+		return definition, true
+	}
+	if definition, ok := structureCommands[name]; ok {
+		return definition, true
+	}
+	definition, ok := scriptCommands[name]
+	return definition, ok
+}
+
+// flagWorkload builds the workload the flags describe.
+func flagWorkload() (*workload, error) {
+	spec := *mix
+	if *template != "" {
+		spec = workloadTemplates[*template]
+	}
+	w, err := parseMix(spec)
+	if err != nil {
+		return nil, fmt.Errorf("--mix: %s", err)
+	}
+	for _, command := range w.commands {
+		if command.name == "EVALSHA" {
+			return nil, fmt.Errorf("--mix: EVALSHA needs the script of a --workload file")
+		}
+	}
+	if *collectionSize < 1 {
+		return nil, fmt.Errorf("--collection-size must be at least 1, got %d", *collectionSize)
+	}
+	w.collectionSize = *collectionSize
+	w.keys, err = newKeyDistribution(*keys, *keyCount, *zipfSkew, *hotspotKeyFraction, *hotspotOpFraction)
+	if err != nil {
+		return nil, fmt.Errorf("--keys: %s", err)
+	}
+	w.values, err = parseValueSizes(*valueSize)
+	if err != nil {
+		return nil, fmt.Errorf("--value-size: %s", err)
+	}
+	w.keyspaces, err = parseKeyspaces(*keyspacesFlag)
+	if err != nil {
+		return nil, fmt.Errorf("--keyspaces: %s", err)
+	}
+	w.seed = *seed
+	w.populate = *populateKeyspace
+	return w, nil
+}
+
+// parseMix parses a command mix such as GET:80,SET:18,DEL:2 into a workload.
+func parseMix(spec string) (*workload, error) {
+	w := &workload{}
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid command %q, expected COMMAND:WEIGHT", field)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q for %s", parts[1], parts[0])
+		}
+		if err := w.addCommand(parts[0], weight); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *workload) addCommand(name string, weight int) error {
+	definition, ok := lookupCommand(strings.ToUpper(name))
+	if !ok {
+		return fmt.Errorf("unsupported command %q", name)
+	}
+	if weight <= 0 {
+		return fmt.Errorf("invalid weight %d for %s", weight, name)
+	}
+	w.commands = append(w.commands, workloadCommand{
+		name:     strings.ToUpper(name),
+		weight:   weight,
+		dataType: definition.dataType,
+		args:     definition.args,
+		followUp: definition.followUp,
+	})
+	w.totalWeight += weight
+	return nil
+}
+
+// dataTypes lists the types of the keys the workload's commands work on.
+func (w *workload) dataTypes() []string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, command := range w.commands {
+		if !seen[command.dataType] {
+			seen[command.dataType] = true
+			types = append(types, command.dataType)
+		}
+	}
+	return types
+}
+
+func (w *workload) commandNames() []string {
+	names := make([]string, len(w.commands))
+	for i, command := range w.commands {
+		names[i] = command.name
+	}
+	return names
+}
+
+// generator produces one worker's stream of commands from a workload.
+type generator struct {
+	workload *workload
+	rng      *rand.Rand
+	nextKey  func() int64
+	// bytes counts the value bytes generated since the last takeBytes.
+	bytes uint64
+}
+
+func newGenerator(s *stage, seed int64) *generator {
+	g := &generator{
+		workload: s.opts.workload,
+		rng:      rand.New(rand.NewSource(seed)),
+	}
+	g.nextKey = g.workload.keys.picker(g.rng, &s.keyPosition)
+	return g
+}
+
+// next picks the next command by weight and returns its index in the
+// workload along with its name and arguments.
+func (g *generator) next() (int, string, []interface{}) {
+	pick := g.rng.Intn(g.workload.totalWeight)
+	for index, command := range g.workload.commands {
+		if pick < command.weight {
+			return index, command.name, command.args(g)
+		}
+		pick -= command.weight
+	}
+	panic("unreachable")
+}
+
+// send sends a command followed by its follow-up, if it has one, and returns
+// how many replies they take.
+func (g *generator) send(c conn, commandName string, args []interface{}, followUp followUpFunc) (int, error) {
+	if err := c.Send(commandName, args...); err != nil {
+		return 0, err
+	}
+	if followUp == nil {
+		return 1, nil
+	}
+	followUpName, followUpArgs := followUp(g, args)
+	return 2, c.Send(followUpName, followUpArgs...)
+}
+
+// receiveCommand receives the replies of a command sent with send, returning
+// the command's own reply and the first error among them.
+func receiveCommand(c conn, replies int) (interface{}, error) {
+	reply, err := c.Receive()
+	for i := 1; i < replies; i++ {
+		if _, followUpErr := c.Receive(); err == nil {
+			err = followUpErr
+		}
+	}
+	return reply, err
+}
+
+// key picks the next key from the workload's key distribution.
+func (g *generator) key() string {
+	return keyName(g.nextKey())
+}
+
+// value returns a value sized by the workload's value size distribution.
+func (g *generator) value() []byte {
+	value := g.workload.values.value(g.rng)
+	g.bytes += uint64(len(value))
+	return value
+}
+
+// takeBytes returns the value bytes generated since it was last called.
+func (g *generator) takeBytes() uint64 {
+	bytes := g.bytes
+	g.bytes = 0
+	return bytes
+}
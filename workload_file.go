@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// workloadSpec is the JSON form of a workload given with --workload. Every
+// field is optional and falls back to the matching flag, and phases run one
+// after another, each inheriting what it doesn't set from the top level.
+//
+//	{
+//		"commands": [{"command": "GET", "weight": 90}, {"command": "SET", "weight": 10}],
+//		"keys": {"distribution": "zipf", "count": 100000, "zipf_skew": 0.99},
+//		"value_size": "100:70,4KB:25,256KB:5",
+//		"seed": 42,
+//		"populate": true,
+//		"keyspaces": ["1:tenant-a:", "1:tenant-b:"],
+//		"phases": [{"name": "read-heavy", "duration": "30s"}]
+//	}
+type workloadSpec struct {
+	Commands  []commandSpec `json:"commands"`
+	Keys      *keySpec      `json:"keys"`
+	ValueSize string        `json:"value_size"`
+	Seed      *int64        `json:"seed"`
+	Populate  *bool         `json:"populate"`
+	// Template names one of the built-in data structure mixes in place
+	// of commands.
+	Template       string      `json:"template"`
+	CollectionSize int         `json:"collection_size"`
+	Script         *scriptSpec `json:"script"`
+	// Keyspaces take the form of --keyspaces, a database optionally
+	// followed by a key prefix.
+	Keyspaces []string    `json:"keyspaces"`
+	Phases    []phaseSpec `json:"phases"`
+}
+
+type commandSpec struct {
+	Command string `json:"command"`
+	Weight  int    `json:"weight"`
+}
+
+type keySpec struct {
+	Distribution string  `json:"distribution"`
+	Count        int64   `json:"count"`
+	ZipfSkew     float64 `json:"zipf_skew"`
+	HotspotKeys  float64 `json:"hotspot_keys"`
+	HotspotOps   float64 `json:"hotspot_ops"`
+}
+
+type phaseSpec struct {
+	Name           string        `json:"name"`
+	Duration       string        `json:"duration"`
+	Requests       uint64        `json:"requests"`
+	Commands       []commandSpec `json:"commands"`
+	Keys           *keySpec      `json:"keys"`
+	ValueSize      string        `json:"value_size"`
+	Populate       *bool         `json:"populate"`
+	Template       string        `json:"template"`
+	CollectionSize int           `json:"collection_size"`
+	Script         *scriptSpec   `json:"script"`
+	Keyspaces      []string      `json:"keyspaces"`
+}
+
+// loadWorkloadFile reads and validates a workload spec, returning a workload
+// per phase.
+func loadWorkloadFile(path string) ([]*workload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var spec workloadSpec
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	phases := spec.Phases
+	if len(phases) == 0 {
+		phases = []phaseSpec{{}}
+	}
+
+	var workloads []*workload
+	for index, phase := range phases {
+		w, err := spec.phaseWorkload(path, phase)
+		if err != nil {
+			if phase.Name != "" {
+				return nil, fmt.Errorf("%s: phase %q: %s", path, phase.Name, err)
+			}
+			return nil, fmt.Errorf("%s: phase %d: %s", path, index+1, err)
+		}
+		workloads = append(workloads, w)
+	}
+	return workloads, nil
+}
+
+func (spec *workloadSpec) phaseWorkload(path string, phase phaseSpec) (*workload, error) {
+	w := &workload{name: phase.Name, requests: phase.Requests, seed: *seed}
+	if spec.Seed != nil {
+		w.seed = *spec.Seed
+	}
+	w.populate = *populateKeyspace
+	if spec.Populate != nil {
+		w.populate = *spec.Populate
+	}
+	if phase.Populate != nil {
+		w.populate = *phase.Populate
+	}
+	if phase.Duration != "" {
+		var err error
+		w.duration, err = time.ParseDuration(phase.Duration)
+		if err != nil || w.duration <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", phase.Duration)
+		}
+	}
+
+	commands, templateName := spec.Commands, spec.Template
+	if len(phase.Commands) > 0 || phase.Template != "" {
+		commands, templateName = phase.Commands, phase.Template
+	}
+	if len(commands) > 0 && templateName != "" {
+		return nil, fmt.Errorf("set either commands or template, not both")
+	}
+	if len(commands) == 0 {
+		if templateName == "" {
+			templateName = *template
+		}
+		mixSpec := *mix
+		if templateName != "" {
+			var ok bool
+			if mixSpec, ok = workloadTemplates[templateName]; !ok {
+				return nil, fmt.Errorf("unknown template %q", templateName)
+			}
+		}
+		mixed, err := parseMix(mixSpec)
+		if err != nil {
+			return nil, fmt.Errorf("commands: %s", err)
+		}
+		w.commands, w.totalWeight = mixed.commands, mixed.totalWeight
+	}
+	for _, command := range commands {
+		if err := w.addCommand(command.Command, command.Weight); err != nil {
+			return nil, fmt.Errorf("commands: %s", err)
+		}
+	}
+
+	w.collectionSize = *collectionSize
+	if spec.CollectionSize != 0 {
+		w.collectionSize = spec.CollectionSize
+	}
+	if phase.CollectionSize != 0 {
+		w.collectionSize = phase.CollectionSize
+	}
+	if w.collectionSize < 1 {
+		return nil, fmt.Errorf("collection_size must be at least 1, got %d", w.collectionSize)
+	}
+
+	keySpec := keySpec{
+		Distribution: *keys,
+		Count:        *keyCount,
+		ZipfSkew:     *zipfSkew,
+		HotspotKeys:  *hotspotKeyFraction,
+		HotspotOps:   *hotspotOpFraction,
+	}
+	keySpec.override(spec.Keys)
+	keySpec.override(phase.Keys)
+	var err error
+	w.keys, err = newKeyDistribution(keySpec.Distribution, keySpec.Count, keySpec.ZipfSkew, keySpec.HotspotKeys, keySpec.HotspotOps)
+	if err != nil {
+		return nil, fmt.Errorf("keys: %s", err)
+	}
+
+	valueSize := *valueSize
+	if spec.ValueSize != "" {
+		valueSize = spec.ValueSize
+	}
+	if phase.ValueSize != "" {
+		valueSize = phase.ValueSize
+	}
+	w.values, err = parseValueSizes(valueSize)
+	if err != nil {
+		return nil, fmt.Errorf("value_size: %s", err)
+	}
+
+	keyspaces := spec.Keyspaces
+	if len(phase.Keyspaces) > 0 {
+		keyspaces = phase.Keyspaces
+	}
+	if len(keyspaces) == 0 {
+		if w.keyspaces, err = parseKeyspaces(*keyspacesFlag); err != nil {
+			return nil, fmt.Errorf("keyspaces: %s", err)
+		}
+	}
+	for _, field := range keyspaces {
+		ks, err := parseKeyspace(field)
+		if err != nil {
+			return nil, fmt.Errorf("keyspaces: %s", err)
+		}
+		w.keyspaces = append(w.keyspaces, ks)
+	}
+
+	script := spec.Script
+	if phase.Script != nil {
+		script = phase.Script
+	}
+	if script != nil {
+		if w.script, err = loadScript(path, script); err != nil {
+			return nil, err
+		}
+	}
+	for _, command := range w.commands {
+		if command.name == "EVALSHA" && w.script == nil {
+			return nil, fmt.Errorf("commands: EVALSHA needs a script")
+		}
+	}
+	return w, nil
+}
+
+// override replaces the fields other sets.
+func (k *keySpec) override(other *keySpec) {
+	if other == nil {
+		return
+	}
+	if other.Distribution != "" {
+		k.Distribution = other.Distribution
+	}
+	if other.Count != 0 {
+		k.Count = other.Count
+	}
+	if other.ZipfSkew != 0 {
+		k.ZipfSkew = other.ZipfSkew
+	}
+	if other.HotspotKeys != 0 {
+		k.HotspotKeys = other.HotspotKeys
+	}
+	if other.HotspotOps != 0 {
+		k.HotspotOps = other.HotspotOps
+	}
+}